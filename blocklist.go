@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// how often the blocklist files are stat'ed for changes, at most
+const BLOCKLISTCHECKINTERVAL = 5 * time.Second
+
+// ipTrie is a binary prefix trie over 128 bit addresses. IPv4 goes in as v4-mapped IPv6 (::ffff:a.b.c.d/96+len)
+// so one lookup covers both
+type ipTrie struct {
+	root trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// a prefix ends here, everything below is covered
+	terminal bool
+}
+
+// insert() adds ip/prefixLen, ip in 16 byte form
+func (t *ipTrie) insert(ip net.IP, prefixLen int) {
+	node := &t.root
+	for i := 0; i < prefixLen; i++ {
+		if node.terminal {
+			// already covered by a shorter prefix
+			return
+		}
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	if !node.terminal {
+		node.terminal = true
+		// anything longer is now redundant
+		node.children = [2]*trieNode{}
+		t.size++
+	}
+}
+
+// contains() walks the trie until it hits the end of a prefix or falls off
+func (t *ipTrie) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	node := &t.root
+	for i := 0; i < 128; i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[(ip[i/8]>>(7-uint(i%8)))&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+// parseBlocklistLine() reads one line of a plain, CIDR, FireHOL (.netset/.ipset, # comments) or
+// Spamhaus DROP ("1.10.16.0/20 ; SBL256894") list. ok is false for blank and comment lines
+func parseBlocklistLine(line string) (ip net.IP, prefixLen int, ok bool, err error) {
+	if i := strings.IndexAny(line, "#;"); i != -1 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, 0, false, nil
+	}
+	entry := fields[0]
+
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("bad CIDR %q", entry)
+		}
+		ones, bits := ipnet.Mask.Size()
+		return ipnet.IP.To16(), ones + 128 - bits, true, nil
+	}
+
+	parsed := net.ParseIP(entry)
+	if parsed == nil {
+		return nil, 0, false, fmt.Errorf("bad IP address %q", entry)
+	}
+	return parsed.To16(), 128, true, nil
+}
+
+// readBlocklist() adds every entry of one file to the trie. Bad lines are counted, not fatal: one typo from the feed should not drop the whole list
+func readBlocklist(r io.Reader, trie *ipTrie) (bad int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ip, prefixLen, ok, err := parseBlocklistLine(scanner.Text())
+		if err != nil {
+			bad++
+			continue
+		}
+		if ok {
+			trie.insert(ip, prefixLen)
+		}
+	}
+	return bad, scanner.Err()
+}
+
+// blocklistFiles() expands the blocklists config: files as is, directories to the (non hidden) files in them. The paths that
+// can not be read come back as problems, a typo must not quietly turn into an empty deny list
+func blocklistFiles(paths []string) (files []string, problems []string) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("blocklist %s", err))
+			continue
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("blocklist %s", err))
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, problems
+}
+
+// blocklistSignature() changes whenever a file is added, removed or rewritten
+func blocklistSignature(files []string) string {
+	var sig strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&sig, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return sig.String()
+}
+
+// blocklist holds the parsed blocklist files. It is rebuilt when the files change and swapped in whole
+var blocklist = struct {
+	sync.Mutex
+	trie      *ipTrie
+	paths     string
+	problems  string
+	signature string
+	checked   time.Time
+}{}
+
+// loadBlocklists() re-reads the files when their signature changed since the last load
+func loadBlocklists(paths []string) *ipTrie {
+	blocklist.Lock()
+	defer blocklist.Unlock()
+
+	// a new list of paths (config reload) is checked right away
+	joined := strings.Join(paths, "\n")
+	if blocklist.trie != nil && joined == blocklist.paths && time.Since(blocklist.checked) < BLOCKLISTCHECKINTERVAL {
+		return blocklist.trie
+	}
+	blocklist.paths = joined
+	blocklist.checked = time.Now()
+
+	files, problems := blocklistFiles(paths)
+	// said once, not on every check
+	if joined := strings.Join(problems, "\n"); joined != blocklist.problems {
+		for _, problem := range problems {
+			fmt.Printf("error> %s\n", problem)
+			CoolLogger.Printf("[%s] %s\n", color.HiYellowString("WARN"), problem)
+		}
+		blocklist.problems = joined
+	}
+	signature := blocklistSignature(files)
+	if blocklist.trie != nil && signature == blocklist.signature {
+		return blocklist.trie
+	}
+
+	trie := &ipTrie{}
+	bad := 0
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Printf("error> %s\n", err)
+			continue
+		}
+		n, err := readBlocklist(f, trie)
+		f.Close()
+		if err != nil {
+			fmt.Printf("error> %s: %s\n", file, err)
+		}
+		bad += n
+	}
+
+	blocklist.trie = trie
+	blocklist.signature = signature
+	CoolLogger.Printf("[%s] loaded %d entries from %d files (%d bad lines skipped)\n", color.CyanString("BLOCKLIST"), trie.size, len(files), bad)
+	return trie
+}
+
+// inBlocklists() says whether ip is in any of the blocklist files
+func inBlocklists(ip string, paths []string) bool {
+	if len(paths) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	return loadBlocklists(paths).contains(parsed)
+}
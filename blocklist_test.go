@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBlocklistFormats(t *testing.T) {
+	list := `# firehol_level1 netset
+1.10.16.0/20 ; SBL256894
+203.0.113.7
+2001:db8::/32 # a v6 block
+not-an-ip
+10.0.0.0/33
+`
+	trie := &ipTrie{}
+	bad, err := readBlocklist(strings.NewReader(list), trie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bad != 2 {
+		t.Errorf("bad = %d, want 2", bad)
+	}
+
+	for ip, want := range map[string]bool{
+		"1.10.16.1":          true,
+		"1.10.31.255":        true,
+		"1.10.32.0":          false,
+		"203.0.113.7":        true,
+		"203.0.113.8":        false,
+		"::ffff:203.0.113.7": true,
+		"2001:db8:ffff::1":   true,
+		"2001:db9::1":        false,
+	} {
+		if got := trie.contains(net.ParseIP(ip)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestBlocklistRefreshesOnChange(t *testing.T) {
+	CoolLogger = log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	config := Config{Blocklists: []string{dir}}
+
+	if config.BannedIP("198.51.100.9") {
+		t.Fatal("empty blocklist directory banned an address")
+	}
+
+	// the feed drops a new file
+	if err := ioutil.WriteFile(filepath.Join(dir, "drop.txt"), []byte("198.51.100.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocklist.Lock()
+	blocklist.checked = time.Time{}
+	blocklist.Unlock()
+
+	if !config.BannedIP("198.51.100.9") {
+		t.Error("new blocklist file was not picked up")
+	}
+
+	// and takes it away again
+	if err := os.Remove(filepath.Join(dir, "drop.txt")); err != nil {
+		t.Fatal(err)
+	}
+	blocklist.Lock()
+	blocklist.checked = time.Time{}
+	blocklist.Unlock()
+
+	if config.BannedIP("198.51.100.9") {
+		t.Error("removed blocklist file is still banning")
+	}
+}
+
+func TestMissingBlocklistIsReported(t *testing.T) {
+	_, out := setupReceive(t, "bonk", testConfig)
+	missing := filepath.Join(t.TempDir(), "fireho1.netset")
+	config := Config{Blocklists: []string{missing}}
+
+	checked, _ := config.Check()
+	warnings := strings.Join(checked, "\n")
+	if !strings.Contains(warnings, missing) {
+		t.Errorf("missing blocklist not flagged: %q", warnings)
+	}
+
+	// logged once, not every time the files are checked
+	for i := 0; i < 2; i++ {
+		blocklist.Lock()
+		blocklist.checked = time.Time{}
+		blocklist.Unlock()
+		config.BannedIP("198.51.100.9")
+	}
+	if n := strings.Count(out.String(), "[WARN] blocklist stat "+missing); n != 1 {
+		t.Errorf("got %d warnings for the missing file:\n%s", n, out.String())
+	}
+
+	// and a reload says so too
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"allowed-user": ["root"], "blocklists": ["`+missing+`"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "[WARN] blocklist stat "+missing) {
+		t.Errorf("reload did not warn:\n%s", out.String())
+	}
+}
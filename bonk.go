@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"embed"
 	"errors"
 	"flag"
@@ -11,6 +10,8 @@ import (
 	"os"
 	"os/user"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/elastic/go-libaudit/v2"
 	"github.com/elastic/go-libaudit/v2/auparse"
@@ -23,7 +24,7 @@ var (
 	rate            = fs.Uint("rate", 0, "rate limit in kernel (default 0, no rate limit)")
 	backlog         = fs.Uint("backlog", 8192, "backlog limit")
 	receiveOnly     = fs.Bool("ro", false, "receive only using multicast, requires kernel 3.16+")
-	mode            = fs.String("mode", "load", "[load/bonk/list] choose between\n>'load' (load rules)\n>'bonk' (bonk processes)\n>'honk' (just honk no bonk)\n")
+	mode            = fs.String("mode", "load", "[load/bonk/list] choose between\n>'load' (load rules)\n>'bonk' (bonk processes)\n>'honk' (just honk no bonk)\n>'replay' (honk a recorded log, default /var/log/bonk/bonk-verbose.log)\n>'sync' (make the kernel rules match ours, adding and deleting only what changed)\n>'lint' (check the rules and bonkable keys without touching the kernel, extra rule files can follow)\n>'unblock' (take the IPs that follow off the firewall)\n>'checkconfig' (validate the config, or the file that follows, without running)\n>'thaw' (let the frozen pids that follow go on, lists them without pids)\n>'kill-frozen' (kill everything bonk froze)\n")
 	verbose         = fs.Bool("v", true, "whether to print to stdout or not")
 	colorEnabled    = fs.Bool("color", true, "whether to use color or not")
 	configPath      = fs.String("config", "", "where custom config is located")
@@ -31,10 +32,18 @@ var (
 	BonksBeforeWarn = fs.Int("warn", 10, "Number of bonkable offenses before IP address is said to be a potential threat of an IP")
 	BonkByIPAllow   = fs.Bool("bonkip-a", false, "do not bonk processes in the allow list set by /etc/bonk/config.json (defualt false)")
 	BonkByIPDeny    = fs.Bool("bonkip-d", false, "kills IP addresses in the deny list set by /etc/bonk/config.json (defualt false)")
+	format          = fs.String("format", "text", "[text/json] how decisions are written to /var/log/bonk/bonk.log, json is one object per line")
+	dryRun          = fs.Bool("dry-run", false, "with -mode=sync only print what would be added and deleted")
+	blockIPs        = fs.Bool("block", false, "block offending IPs (deny list hits and IPs past -warn) at the firewall, nftables or iptables")
+	blockTTL        = fs.Duration("block-ttl", time.Hour, "how long a -block lasts")
+	watch           = fs.Bool("watch", false, "with -mode=bonk/honk also reload the config when the file changes (SIGHUP always reloads it)")
+	evidence        = fs.Bool("evidence", true, "with -mode=bonk save an evidence bundle of every process under /var/bonk/evidence before killing it")
+	decay           = fs.Duration("decay", 24*time.Hour, "IP offense counts halve after this long without a new offense (0 never decays)")
+	eventTimeout    = fs.Duration("timeout", 500*time.Millisecond, "how long to wait for the end of an audit event (EOE) before judging it anyway")
 	cf              = Config{}
 	RawLogger       *log.Logger
 	CoolLogger      *log.Logger
-	IPAddresses     map[string]int
+	IPAddresses     map[string]*ipRecord
 	// ptraceKill   = fs.Bool("ptrace", false, "use ptrace trolling to kill process rudely")
 	// immutable    = fs.Bool("immutable", false, "make kernel audit settings immutable (requires reboot to undo)")
 
@@ -54,34 +63,38 @@ const (
 	LOGSPATH     = "/var/log/bonk/bonk.log"
 	LOGSRAWPATH  = "/var/log/bonk/bonk-verbose.log"
 	LOGSCOOLPATH = "/var/log/bonk/bonk-cool.log"
-	IPADDRESSES  = "/etc/bonk/ips"
+	// per IP offense counts, kept across restarts
+	IPSTATEPATH = "/var/bonk/ips.json"
+
+	// how many interleaved events the reassembler buffers before it judges the oldest one
+	REASSEMBLYMAXINFLIGHT = 50
 )
 
 func init() {
-	IPAddresses = make(map[string]int)
+	IPAddresses = make(map[string]*ipRecord)
+}
+
+// setupLogging() opens the bonk logs and creates the bonk directories. It needs root, so replay skips it
+func setupLogging() {
 	// set up logging
 	logFile, err := os.OpenFile(LOGSPATH, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
 
+	// stdout is handled by -v, the log file always gets a copy
 	CoolLogger = log.New(logFile, "", log.Ltime|log.Lshortfile)
-
-	// only log when in bonk mode
-	if *mode == "bonk" {
-		mw := io.MultiWriter(os.Stdout, logFile)
-		CoolLogger.SetOutput(mw)
-	} else {
-		CoolLogger.SetOutput(logFile)
+	JSONLogger.SetOutput(logFile)
+	if *format == "json" {
+		// one JSON object per line, the EVIDENCE/BLOCK/RELOAD ... lines included
+		CoolLogger = log.New(jsonLines{}, "", 0)
 	}
 
-	RawLogger = log.New(logFile, "", log.Lshortfile)
-
 	logRawFile, err := os.OpenFile(LOGSRAWPATH, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
-	RawLogger.SetOutput(logRawFile)
+	RawLogger = log.New(logRawFile, "", log.Lshortfile)
 
 	// create /var/bonk & /etc/bonk
 	path := "/var/bonk"
@@ -104,16 +117,6 @@ func init() {
 }
 
 func main() {
-	// ensure we are root
-	user, err := user.Current()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if user.Username != "root" {
-		log.Fatal("not root!")
-	}
-
 	// parse flags
 	fs.Parse(os.Args[1:])
 	fmt.Printf("FLAGS:\n%+v\n", fs.Args())
@@ -122,16 +125,98 @@ func main() {
 		color.NoColor = true
 	}
 
-	// load configuration file
-	if *configPath == "" {
-		fmt.Printf("[!] Loading %s ... \n", CONFIGPATH)
-		cf.Load(CONFIGPATH)
+	if *format != "text" && *format != "json" {
+		log.Fatalf("error: unknown -format %q, want text or json", *format)
+	}
+
+	// replay, lint and checkconfig only read files, everything else talks to the kernel
+	if *mode == "replay" || *mode == "lint" || *mode == "checkconfig" {
+		CoolLogger = log.New(io.Discard, "", 0)
+		RawLogger = log.New(io.Discard, "", 0)
+		JSONLogger.SetOutput(os.Stdout)
 	} else {
-		fmt.Printf("[!] Loading %s... \n", *configPath)
+		// ensure we are root
+		user, err := user.Current()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if user.Username != "root" {
+			log.Fatal("not root!")
+		}
+		setupLogging()
+	}
+
+	// load configuration file, a fresh box gets the default one
+	if *configPath == "" {
 		dumpConfig()
-		cf.Load(*configPath)
+	}
+
+	if *mode == "checkconfig" {
+		path := configFile()
+		if fs.NArg() > 0 {
+			path = fs.Arg(0)
+		}
+		if err := checkConfig(path); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
+	fmt.Printf("[!] Loading %s ... \n", configFile())
+	if err := cf.Load(configFile()); err != nil {
+		// running on half a config is how root ends up bonked
+		log.Fatalf("error: invalid config, refusing to start (check it with -mode=checkconfig): %v", err)
+	}
+	warnings, errs := cf.Check()
+	if len(errs) > 0 && *mode == "bonk" {
+		// an allowed user that never matches gets bonked
+		log.Fatalf("error: %s, refusing to start (check it with -mode=checkconfig)", strings.Join(errs, "; "))
+	}
+	for _, warning := range append(warnings, errs...) {
+		fmt.Printf("[%s] %s\n", color.HiYellowString("WARN"), warning)
 	}
 	fmt.Printf("CONFIG:\n%+v\n\n", cf)
+
+	if *mode == "replay" {
+		path := LOGSRAWPATH
+		if fs.NArg() > 0 {
+			path = fs.Arg(0)
+		}
+		if err := replay(path); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
+	if *mode == "lint" {
+		if err := lint(fs.Args()); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
+	if *mode == "unblock" {
+		if err := unblock(fs.Args()); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
+	if *mode == "thaw" {
+		if err := thaw(fs.Args()); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
+	if *mode == "kill-frozen" {
+		if err := killFrozen(); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return
+	}
+
 	if err := read(); err != nil {
 		log.Fatalf("error: %v", err)
 	}
@@ -172,112 +257,228 @@ func read() error {
 			return fmt.Errorf("failed to create audit client: %w", err)
 		}
 		defer client.Close()
+	}
+	return runMode(client)
+}
 
-		status, err := client.GetStatus()
-		if err != nil {
-			return fmt.Errorf("failed to get audit status: %w", err)
+// runMode() sets the kernel up and runs the mode. sync only reads and edits the rule list, so it leaves auditing, the limits
+// and the audit daemon (a bonk that is already running) alone
+func runMode(client auditSource) error {
+	var err error
+	if !*receiveOnly && *mode != "sync" {
+		if err = setupKernel(client); err != nil {
+			return err
 		}
-		log.Printf("received audit status=%+v", status)
+	}
 
-		if status.Enabled == 0 {
-			log.Println("enabling auditing in the kernel")
-			if err = client.SetEnabled(true, libaudit.WaitForReply); err != nil {
-				return fmt.Errorf("failed to set enabled=true: %w", err)
-			}
+	if *mode == "load" {
+		return load(client)
+	} else if *mode == "sync" {
+		return syncRules(client, *dryRun)
+	} else if *mode == "bonk" || *mode == "honk" {
+		// pick up where the last run left off, an attacker does not get a clean slate from a restart
+		if IPAddresses, err = loadIPState(ipStatePath, time.Now(), *decay); err != nil {
+			fmt.Printf("error> %s: %s\n", ipStatePath, err)
 		}
-
-		if status.RateLimit != uint32(*rate) {
-			log.Printf("setting rate limit in kernel to %v", *rate)
-			if err = client.SetRateLimit(uint32(*rate), libaudit.NoWait); err != nil {
-				return fmt.Errorf("failed to set rate limit to unlimited: %w", err)
+		log.Printf("loaded offense state for %d IPs", len(IPAddresses))
+		if frozen, err := pruneFrozen(); err != nil {
+			fmt.Printf("error> %s\n", err)
+		} else if len(frozen) > 0 {
+			log.Printf("%d processes are still frozen, see -mode=thaw", len(frozen))
+		}
+		startProcTree()
+		// the audit pid stays registered across config changes, restarting would let the backlog overflow
+		watchConfig(configFile())
+		if *blockIPs && *mode == "bonk" {
+			if fw, err = setupFirewall(); err != nil {
+				return fmt.Errorf("failed to set up -block: %w", err)
 			}
+			log.Printf("blocking offending IPs with %s for %s", fw.Name(), *blockTTL)
+			startBlockExpiry(fw)
 		}
+		return receive(client)
+	} else {
+		flag.PrintDefaults()
+		return fmt.Errorf("please specify which mode to use")
+	}
 
-		if status.BacklogLimit != uint32(*backlog) {
-			log.Printf("setting backlog limit in kernel to %v", *backlog)
-			if err = client.SetBacklogLimit(uint32(*backlog), libaudit.NoWait); err != nil {
-				return fmt.Errorf("failed to set backlog limit: %w", err)
-			}
+}
+
+// setupKernel() turns auditing on, applies the limits and registers us as the audit daemon
+func setupKernel(r auditSource) error {
+	status, err := r.GetStatus()
+	if err != nil {
+		return fmt.Errorf("failed to get audit status: %w", err)
+	}
+	log.Printf("received audit status=%+v", status)
+
+	if status.Enabled == 0 {
+		log.Println("enabling auditing in the kernel")
+		if err = r.SetEnabled(true, libaudit.WaitForReply); err != nil {
+			return fmt.Errorf("failed to set enabled=true: %w", err)
 		}
+	}
 
-		// do **not** want to enable immutable kernel **yet**
-		// if status.Enabled != 2 {
-		// 	log.Printf("setting kernel settings as immutable")
-		// 	if err = client.SetImmutable(libaudit.NoWait); err != nil {
-		// 		return fmt.Errorf("failed to set kernel as immutable: %w", err)
-		// 	}
-		// }
-
-		log.Printf("sending message to kernel registering our PID (%v) as the audit daemon", os.Getpid())
-		if err = client.SetPID(libaudit.NoWait); err != nil {
-			return fmt.Errorf("failed to set audit PID: %w", err)
+	if status.RateLimit != uint32(*rate) {
+		log.Printf("setting rate limit in kernel to %v", *rate)
+		if err = r.SetRateLimit(uint32(*rate), libaudit.NoWait); err != nil {
+			return fmt.Errorf("failed to set rate limit to unlimited: %w", err)
 		}
+	}
 
+	if status.BacklogLimit != uint32(*backlog) {
+		log.Printf("setting backlog limit in kernel to %v", *backlog)
+		if err = r.SetBacklogLimit(uint32(*backlog), libaudit.NoWait); err != nil {
+			return fmt.Errorf("failed to set backlog limit: %w", err)
+		}
 	}
 
-	if *mode == "load" {
-		return load(client)
-	} else if *mode == "bonk" || *mode == "honk" {
-		return receive(client)
-	} else {
-		flag.PrintDefaults()
-		return fmt.Errorf("please specify which mode to use")
+	// do **not** want to enable immutable kernel **yet**
+	// if status.Enabled != 2 {
+	// 	log.Printf("setting kernel settings as immutable")
+	// 	if err = r.SetImmutable(libaudit.NoWait); err != nil {
+	// 		return fmt.Errorf("failed to set kernel as immutable: %w", err)
+	// 	}
+	// }
+
+	log.Printf("sending message to kernel registering our PID (%v) as the audit daemon", os.Getpid())
+	if err = r.SetPID(libaudit.NoWait); err != nil {
+		return fmt.Errorf("failed to set audit PID: %w", err)
 	}
 
+	return nil
 }
 
 // command to load our rules
-func load(r *libaudit.AuditClient) error {
+func load(r auditSource) error {
 
-	data, err := res.Open("embed/good.rules")
+	rules, err := wantedRules()
 	if err != nil {
 		return err
 	}
-	defer data.Close()
 
-	scanner := bufio.NewScanner(data)
-	for scanner.Scan() {
-		if rule2add := scanner.Text(); !strings.HasPrefix(rule2add, "#") && rule2add != "" {
+	var loaded, failed []ruleLine
+	for _, rule2add := range rules {
+		if *verbose {
+			fmt.Printf("rule> %s\n", rule2add.Rule)
+		}
+		err := ruleAddWrapper(rule2add.Rule, r)
+		// r.WaitForPendingACKs()
+		if err != nil {
 			if *verbose {
-				fmt.Printf("rule> %s\n", rule2add)
-			}
-			err := ruleAddWrapper(rule2add, r)
-			// r.WaitForPendingACKs()
-			if err != nil && *verbose {
-				fmt.Printf("error> %s\n", err)
+				fmt.Printf("error> %s %s\n", rule2add, err)
 			}
-
+			failed = append(failed, rule2add)
+			continue
 		}
+		loaded = append(loaded, rule2add)
+	}
 
+	// report where every rule came from
+	fmt.Printf("[!] loaded %d rules, %d failed\n", len(loaded), len(failed))
+	for _, rule2add := range loaded {
+		fmt.Printf("[%s] %s\t%s\n", color.GreenString("+"), rule2add, rule2add.Rule)
+	}
+	for _, rule2add := range failed {
+		fmt.Printf("[%s] %s\t%s\n", color.RedString("x"), rule2add, rule2add.Rule)
 	}
 
-	for _, rule := range cf.Rules {
-		if strings.HasPrefix(rule, "#") && rule != "" {
-			err := ruleAddWrapper(rule, r)
-			// r.WaitForPendingACKs()
-			if err != nil && *verbose {
+	return nil
+}
 
-				fmt.Printf("error> %s\n", err)
+// bonkStream receives the events put back together by the reassembler and judges them
+type bonkStream struct {
+	// events complete from both the receive loop (EOE) and the maintenance ticker (timeout)
+	mu          sync.Mutex
+	prevMessage string
+}
 
-			}
-		}
+func (s *bonkStream) ReassemblyComplete(msgs []*auparse.AuditMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, err := NewAuditMessageBonk(msgs)
+	if err != nil && *verbose {
+		fmt.Println(err)
 	}
 
-	return nil
+	if a.Pid > 0 {
+		trackProcess(a)
+		a.Ancestry = ancestryOf(a.Pid, a.PPid, a.Exe, a.Comm)
+		a.setContainer()
+	}
+
+	// THIS IS THE BONK LOGIC
+	if *mode == "bonk" || *mode == "honk" || *mode == "replay" {
+		cfMu.Lock()
+		s.prevMessage, _ = bonkProc(a, s.prevMessage)
+		cfMu.Unlock()
+	}
+}
+
+func (s *bonkStream) EventsLost(count int) {
+	CoolLogger.Printf("[WARN] %d audit events were lost\n", count)
 }
 
 // mode=bonk,honk : takes the libaudit client and monitors for naughty processes
-func receive(r *libaudit.AuditClient) error {
+// maintainTick() is how often timed out events are looked for, twice per timeout but never so often it spins (or, under
+// a -timeout of 1ns, is 0 and takes the ticker down)
+func maintainTick(timeout time.Duration) time.Duration {
+	if tick := timeout / 2; tick > time.Millisecond {
+		return tick
+	}
+	return time.Millisecond
+}
+
+func receive(r auditSource) error {
+
+	if *eventTimeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %v", *eventTimeout)
+	}
 
-	var a AuditMessageBonk
-	prevMessage := ""
+	reassembler, err := libaudit.NewReassembler(REASSEMBLYMAXINFLIGHT, *eventTimeout, &bonkStream{})
+	if err != nil {
+		return fmt.Errorf("failed to create reassembler: %w", err)
+	}
+	// the last events judged on Close may still be copying their exe
+	defer evidenceWG.Wait()
+	defer reassembler.Close()
+
+	// events whose EOE never shows up still get judged once they time out
+	stop := make(chan struct{})
+	var maintainer sync.WaitGroup
+	maintainer.Add(1)
+	go func(tick time.Duration) {
+		defer maintainer.Done()
+		t := time.NewTicker(tick)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if err := reassembler.Maintain(); err != nil {
+					return
+				}
+			}
+		}
+	}(maintainTick(*eventTimeout))
+	// nothing gets judged behind the caller's back once receive returns
+	defer func() {
+		close(stop)
+		maintainer.Wait()
+	}()
 
-	// var outMessagePrev string
 	for {
 
 		rawEvent, err := r.Receive(false)
+		if errors.Is(err, io.EOF) {
+			// only a finite source (not the kernel) runs dry, the deferred Close judges what is left
+			return nil
+		}
 		if err != nil {
 			fmt.Println(fmt.Errorf("receive failed: %w", err))
+			continue
 		}
 
 		// Messages from 1300-2999 are valid audit messages.
@@ -289,25 +490,9 @@ func receive(r *libaudit.AuditClient) error {
 		// always save the raw audit log (for future investigation, of course
 		RawLogger.Printf("type=%v msg=%v\n", rawEvent.Type, string(rawEvent.Data))
 
-		// THIS IS THE BONK LOGIC
-		if a.IsNewAuditID(string(rawEvent.Data)) {
-			// so this is a new audit message
-			// bonk the cumulative message
-			if *mode == "bonk" || *mode == "honk" {
-				prevMessage, _ = bonkProc(a, prevMessage)
-			}
-			// then make new audit message
-			a = AuditMessageBonk{}
-			err := a.InitAuditMessage(string(rawEvent.Data))
-			if err != nil && *verbose {
-				fmt.Print(err)
-			}
-		} else {
-			// otherwise just append to audit class
-			err := a.InitAuditMessage(string(rawEvent.Data))
-			if err != nil && *verbose {
-				fmt.Print(err)
-			}
+		// group the records by their audit ID, events finished by an EOE get handed to bonkStream right away
+		if err := reassembler.Push(rawEvent.Type, rawEvent.Data); err != nil && *verbose {
+			fmt.Printf("error> %s\n", err)
 		}
 
 	}
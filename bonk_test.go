@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-libaudit/v2"
+	"github.com/elastic/go-libaudit/v2/auparse"
+	"github.com/fatih/color"
+)
+
+// memorySource is an in-memory auditSource. Receive hands out the queued records and then io.EOF
+type memorySource struct {
+	msgs    []*libaudit.RawAuditMessage
+	rules   [][]byte
+	status  libaudit.AuditStatus
+	enabled bool
+	pidSet  bool
+}
+
+func newMemorySource(t *testing.T, lines ...string) *memorySource {
+	t.Helper()
+	m := &memorySource{}
+	for _, line := range lines {
+		i := strings.Index(line, " msg=")
+		if !strings.HasPrefix(line, "type=") || i == -1 {
+			t.Fatalf("bad record %q", line)
+		}
+		typ, err := auparse.GetAuditMessageType(line[len("type="):i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.msgs = append(m.msgs, &libaudit.RawAuditMessage{Type: typ, Data: []byte(line[i+len(" msg="):])})
+	}
+	return m
+}
+
+func (m *memorySource) Receive(nonBlocking bool) (*libaudit.RawAuditMessage, error) {
+	if len(m.msgs) == 0 {
+		return nil, io.EOF
+	}
+	msg := m.msgs[0]
+	m.msgs = m.msgs[1:]
+	return msg, nil
+}
+
+func (m *memorySource) AddRule(rule []byte) error {
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
+func (m *memorySource) GetRules() ([][]byte, error) {
+	return m.rules, nil
+}
+
+func (m *memorySource) DeleteRule(rule []byte) error {
+	for i, r := range m.rules {
+		if bytes.Equal(r, rule) {
+			m.rules = append(m.rules[:i:i], m.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("rule not found")
+}
+
+func (m *memorySource) GetStatus() (*libaudit.AuditStatus, error) {
+	status := m.status
+	return &status, nil
+}
+
+func (m *memorySource) SetPID(wm libaudit.WaitMode) error {
+	m.pidSet = true
+	return nil
+}
+
+func (m *memorySource) SetEnabled(enabled bool, wm libaudit.WaitMode) error {
+	m.enabled = enabled
+	return nil
+}
+
+func (m *memorySource) SetRateLimit(perSecondLimit uint32, wm libaudit.WaitMode) error {
+	m.status.RateLimit = perSecondLimit
+	return nil
+}
+
+func (m *memorySource) SetBacklogLimit(limit uint32, wm libaudit.WaitMode) error {
+	m.status.BacklogLimit = limit
+	return nil
+}
+
+func (m *memorySource) WaitForPendingACKs() error { return nil }
+
+func (m *memorySource) Close() error { return nil }
+
+// pids far above pid_max so nothing in /proc is ever touched
+const (
+	testPid      = 90000001
+	testOtherPid = 90000002
+)
+
+func syscallRecord(seq, pid int, auid, key string) string {
+	return fmt.Sprintf(`type=SYSCALL msg=audit(1364481363.243:%d): arch=c000003e syscall=101 success=yes exit=0 a0=10 a1=1 a2=0 a3=0 items=0 ppid=1 pid=%d auid=%s uid=0 gid=0 euid=0 suid=0 fsuid=0 egid=0 sgid=0 fsgid=0 tty=pts0 ses=1 comm="gdb" exe="/usr/bin/gdb" key="%s"`, seq, pid, auid, key)
+}
+
+func proctitleRecord(seq int, cmd string) string {
+	return fmt.Sprintf(`type=PROCTITLE msg=audit(1364481363.243:%d): proctitle=%X`, seq, strings.ReplaceAll(cmd, " ", "\x00"))
+}
+
+func eoeRecord(seq int) string {
+	return fmt.Sprintf(`type=EOE msg=audit(1364481363.243:%d): `, seq)
+}
+
+// setupReceive points the globals at a test config and returns the pids that got killed plus the log output
+func setupReceive(t *testing.T, m string, config Config) (*[]int, *bytes.Buffer) {
+	t.Helper()
+
+	color.NoColor = true
+	*mode = m
+	*verbose = false
+	*showInfo = true
+	*BonkByIPAllow = false
+	*BonkByIPDeny = false
+	*format = "text"
+	*evidence = false
+	cf = config
+
+	out := &bytes.Buffer{}
+	CoolLogger = log.New(out, "", 0)
+	RawLogger = log.New(io.Discard, "", 0)
+
+	killed := &[]int{}
+	oldKill := killPid
+	killPid = func(pid int) error {
+		*killed = append(*killed, pid)
+		return nil
+	}
+	t.Cleanup(func() { killPid = oldKill })
+
+	// bonked events count against their IPs, that must never reach the real /var/bonk/ips.json
+	oldPath, oldIPs := ipStatePath, IPAddresses
+	ipStatePath = filepath.Join(t.TempDir(), "ips.json")
+	IPAddresses = make(map[string]*ipRecord)
+	t.Cleanup(func() { ipStatePath, IPAddresses = oldPath, oldIPs })
+
+	return killed, out
+}
+
+var testConfig = Config{
+	Users:    []string{"root"},
+	Bonkable: []string{"tracing"},
+}
+
+func TestReceiveBonksBonkableKey(t *testing.T) {
+	killed, out := setupReceive(t, "bonk", testConfig)
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "4294967295", "tracing"),
+		proctitleRecord(100, "gdb -p 1"),
+		eoeRecord(100),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != testPid {
+		t.Errorf("killed %v, want [%d]", *killed, testPid)
+	}
+	if !strings.Contains(out.String(), "[BONK]") || !strings.Contains(out.String(), "gdb -p 1") {
+		t.Errorf("missing bonk log line, got %q", out.String())
+	}
+}
+
+func TestReceiveAllowsAllowedUser(t *testing.T) {
+	killed, out := setupReceive(t, "bonk", testConfig)
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "0", "tracing"),
+		eoeRecord(100),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 0 {
+		t.Errorf("killed %v, want nothing", *killed)
+	}
+	if !strings.Contains(out.String(), "[COOL] USER:root") {
+		t.Errorf("missing cool log line, got %q", out.String())
+	}
+}
+
+func TestReceiveBonksUnknownAuid(t *testing.T) {
+	killed, out := setupReceive(t, "bonk", testConfig)
+	// no such user on the box, it must not pass as allowed
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "3999999999", "tracing"),
+		eoeRecord(100),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != testPid {
+		t.Errorf("killed %v, want [%d]", *killed, testPid)
+	}
+	if !strings.Contains(out.String(), "[BONK] USER:3999999999") {
+		t.Errorf("missing bonk log line, got %q", out.String())
+	}
+}
+
+func TestReceiveLogsNonBonkableKey(t *testing.T) {
+	killed, out := setupReceive(t, "bonk", testConfig)
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "4294967295", "sysctl"),
+		eoeRecord(100),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 0 {
+		t.Errorf("killed %v, want nothing", *killed)
+	}
+	if !strings.Contains(out.String(), "[INFO]") {
+		t.Errorf("missing info log line, got %q", out.String())
+	}
+}
+
+func TestReceiveHonkDoesNotKill(t *testing.T) {
+	killed, out := setupReceive(t, "honk", testConfig)
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "4294967295", "tracing"),
+		eoeRecord(100),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 0 {
+		t.Errorf("killed %v, want nothing", *killed)
+	}
+	if !strings.Contains(out.String(), "[BONK]") {
+		t.Errorf("missing bonk log line, got %q", out.String())
+	}
+}
+
+func TestReceiveKeepsInterleavedEventsApart(t *testing.T) {
+	killed, out := setupReceive(t, "bonk", testConfig)
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "4294967295", "tracing"),
+		syscallRecord(101, testOtherPid, "4294967295", "sysctl"),
+		proctitleRecord(101, "sysctl -w kernel.x=1"),
+		proctitleRecord(100, "gdb -p 1"),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != testPid {
+		t.Errorf("killed %v, want [%d]", *killed, testPid)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Contains(line, "[BONK]") && !strings.Contains(line, "gdb -p 1") {
+			t.Errorf("bonk line got the wrong proctitle: %q", line)
+		}
+		if strings.Contains(line, "[INFO]") && !strings.Contains(line, "sysctl -w") {
+			t.Errorf("info line got the wrong proctitle: %q", line)
+		}
+	}
+}
+
+// blockingSource hands out its records and then blocks (like the kernel with nothing to say) until released
+type blockingSource struct {
+	*memorySource
+	release chan struct{}
+}
+
+func (b *blockingSource) Receive(nonBlocking bool) (*libaudit.RawAuditMessage, error) {
+	if len(b.msgs) == 0 {
+		<-b.release
+	}
+	return b.memorySource.Receive(nonBlocking)
+}
+
+func TestReceiveJudgesEventWithoutEOE(t *testing.T) {
+	setupReceive(t, "bonk", testConfig)
+	oldTimeout := *eventTimeout
+	*eventTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { *eventTimeout = oldTimeout })
+
+	killed := make(chan int, 1)
+	killPid = func(pid int) error {
+		killed <- pid
+		return nil
+	}
+
+	src := &blockingSource{
+		memorySource: newMemorySource(t, syscallRecord(100, testPid, "4294967295", "tracing")),
+		release:      make(chan struct{}),
+	}
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() { errs <- receive(src) }()
+
+	// no EOE and no EOF, only the timeout can judge it
+	select {
+	case pid := <-killed:
+		if pid != testPid {
+			t.Errorf("killed %d, want %d", pid, testPid)
+		}
+		if waited := time.Since(start); waited > 3**eventTimeout {
+			t.Errorf("judged after %v, want about %v", waited, *eventTimeout)
+		}
+	case <-time.After(10 * *eventTimeout):
+		t.Errorf("not judged after %v", 10**eventTimeout)
+	}
+
+	close(src.release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveTinyTimeout(t *testing.T) {
+	setupReceive(t, "bonk", testConfig)
+	oldTimeout := *eventTimeout
+	*eventTimeout = time.Nanosecond
+	t.Cleanup(func() { *eventTimeout = oldTimeout })
+
+	killed := make(chan int, 1)
+	killPid = func(pid int) error {
+		killed <- pid
+		return nil
+	}
+
+	src := &blockingSource{
+		memorySource: newMemorySource(t, syscallRecord(100, testPid, "4294967295", "tracing")),
+		release:      make(chan struct{}),
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- receive(src) }()
+
+	// a 0 tick would have panicked the maintenance goroutine long before this
+	select {
+	case <-killed:
+	case <-time.After(time.Second):
+		t.Error("not judged after 1s")
+	}
+
+	close(src.release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupKernel(t *testing.T) {
+	src := newMemorySource(t)
+
+	if err := setupKernel(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if !src.enabled || !src.pidSet {
+		t.Errorf("enabled=%v pidSet=%v, want both", src.enabled, src.pidSet)
+	}
+	if src.status.BacklogLimit != uint32(*backlog) {
+		t.Errorf("backlog=%d, want %d", src.status.BacklogLimit, *backlog)
+	}
+}
+
+func TestLoadAddsEmbeddedRules(t *testing.T) {
+	setupReceive(t, "load", Config{})
+	src := newMemorySource(t)
+
+	if err := load(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(src.rules) == 0 {
+		t.Error("no rules were added")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+)
+
+// mode=checkconfig : loads a config the same way bonk would and lints the rules it brings along, without running anything
+func checkConfig(path string) error {
+	var config Config
+	if err := config.Load(path); err != nil {
+		fmt.Printf("[%s] %s\n", color.RedString("ERROR"), err)
+		return fmt.Errorf("%s is invalid", path)
+	}
+
+	warnings, errs := config.Check()
+
+	// the rules and the bonkable keys have to agree, lint knows how to check that
+	cf = config
+	*configPath = path
+	rules, err := wantedRules()
+	if err != nil {
+		return err
+	}
+	result := lintRules(rules)
+	warnings = append(warnings, result.warnings...)
+	errs = append(errs, result.errors...)
+
+	for _, msg := range warnings {
+		fmt.Printf("[%s] %s\n", color.HiYellowString("WARN"), msg)
+	}
+	for _, msg := range errs {
+		fmt.Printf("[%s] %s\n", color.RedString("ERROR"), msg)
+	}
+	fmt.Printf("[!] %s: %d errors, %d warnings\n", path, len(errs), len(warnings))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s has %d errors", path, len(errs))
+	}
+	return nil
+}
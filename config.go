@@ -1,17 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 type Config struct {
-	BadIPs   []string `json:"banned-ips"`
-	GoodIPs  []string `json:"allowed-ips"`
-	Users    []string `json:"allowed-user"`
-	Rules    []string `json:"rules"`
-	Bonkable []string `json:"bonkable"`
+	BadIPs  []string `json:"banned-ips"`
+	GoodIPs []string `json:"allowed-ips"`
+	// blocklist files or directories of them, read on top of banned-ips
+	Blocklists []string `json:"blocklists"`
+	Users      []string `json:"allowed-user"`
+	Rules      []string `json:"rules"`
+	RulesDir   string   `json:"rules-dir"`
+	Bonkable   []string `json:"bonkable"`
+	// per key policies, keys in here are bonkable too
+	Policies map[string]Policy `json:"policies"`
+	// binaries that get a pass on bonkable events, pinned by sha256
+	TrustedExes []TrustedExe `json:"trusted-exes"`
+	// binaries that are never killed or stopped, a hit on them is only an alert
+	ProtectedExes []string `json:"protected-exes"`
 }
 
 func (config *Config) Load(path string) error {
@@ -20,30 +36,152 @@ func (config *Config) Load(path string) error {
 		return err
 	}
 
-	err = json.Unmarshal([]byte(file), &config)
-	if err != nil {
+	// a misspelled key would otherwise just be an empty list, and an empty allowed-user bonks root
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%s: trailing data after the config object", path)
+	}
+
+	for key, policy := range config.Policies {
+		checked, err := checkPolicy(key, policy)
+		if err != nil {
+			return err
+		}
+		if checked.Container != nil {
+			container, err := checkPolicy(key+" container", *checked.Container)
+			if err != nil {
+				return err
+			}
+			if container.Container != nil {
+				return fmt.Errorf("policy %q: a container policy can not have its own container policy", key)
+			}
+			checked.Container = &container
+		}
+		config.Policies[key] = checked
+	}
+
+	for _, trusted := range config.TrustedExes {
+		if !filepath.IsAbs(trusted.Path) {
+			return fmt.Errorf("trusted-exes: %q is not an absolute path", trusted.Path)
+		}
+		if !validSHA256(trusted.SHA256) {
+			return fmt.Errorf("trusted-exes: %q has a bad sha256 %q", trusted.Path, trusted.SHA256)
+		}
+	}
+
+	for _, exe := range config.ProtectedExes {
+		if !filepath.IsAbs(exe) {
+			return fmt.Errorf("protected-exes: %q is not an absolute path", exe)
+		}
+	}
+
+	if _, err := parseIPList("banned-ips", config.BadIPs); err != nil {
+		return err
+	}
+	if _, err := parseIPList("allowed-ips", config.GoodIPs); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (config Config) BannedIP(allowMe string) bool {
+// checkPolicy() fills in the defaults of a policy and refuses the ones that make no sense
+func checkPolicy(key string, policy Policy) (Policy, error) {
+	if policy.Action == "" {
+		policy.Action = ActionKill
+	}
+	if !validAction(policy.Action) {
+		return policy, fmt.Errorf("policy %q: unknown action %q (want kill, stop, freeze, log or alert)", key, policy.Action)
+	}
+	if !validScope(policy.Scope) {
+		return policy, fmt.Errorf("policy %q: unknown scope %q (want process, tree, pgroup, session or login)", key, policy.Scope)
+	}
+	if policy.Threshold < 0 {
+		return policy, fmt.Errorf("policy %q: threshold can not be negative", key)
+	}
+	for _, exe := range policy.Exes {
+		if !filepath.IsAbs(exe) {
+			return policy, fmt.Errorf("policy %q: allowed-exe %q is not an absolute path", key, exe)
+		}
+	}
+	// comm names are whatever the process says they are, only exe paths are worth trusting
+	for _, exe := range append(append([]string{}, policy.Ancestors...), policy.AllowedAncestors...) {
+		if !filepath.IsAbs(exe) {
+			return policy, fmt.Errorf("policy %q: ancestor %q is not an absolute path", key, exe)
+		}
+	}
+	for _, pattern := range append(append([]string{}, policy.Cmdline...), policy.AllowedCmdline...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return policy, fmt.Errorf("policy %q: cmdline %q: %w", key, pattern, err)
+		}
+	}
+	return policy, nil
+}
 
-	for _, ip := range config.BadIPs {
-		if strings.Contains(allowMe, ip) {
-			return true
+// Check() looks for things that load fine but are probably not what was meant. The errors are the ones bonk will not run
+// with: an allowed-user that does not resolve never matches, and that user's commands get bonked
+func (config Config) Check() (warnings []string, errs []string) {
+	if len(config.Users) == 0 {
+		warnings = append(warnings, "allowed-user is empty, bonkable events from every user get bonked (root included)")
+	}
+	errs = append(errs, unknownUsers("allowed-user", config.Users)...)
+
+	keys := make([]string, 0, len(config.Policies))
+	for key := range config.Policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		errs = append(errs, unknownUsers(fmt.Sprintf("policy %q allowed-user", key), config.Policies[key].Users)...)
+	}
+
+	_, problems := blocklistFiles(config.Blocklists)
+	warnings = append(warnings, problems...)
+
+	seen := make(map[string]bool)
+	for _, key := range config.Bonkable {
+		if seen[key] {
+			warnings = append(warnings, fmt.Sprintf("bonkable key %q is listed twice", key))
 		}
+		seen[key] = true
 	}
+	return warnings, errs
+}
 
-	return false
+// unknownUsers() lists the users that do not exist on this box. "unset" is the auid of processes nobody logged in for, and
+// a uid without a user behind it is written as the number, which is how its events show it
+func unknownUsers(name string, users []string) []string {
+	var unknown []string
+	for _, u := range users {
+		if u == "unset" {
+			continue
+		}
+		if _, err := strconv.ParseUint(u, 10, 32); err == nil {
+			// a uid that does have a user shows up under the name, the number would never match
+			if known, err := user.LookupId(u); err == nil {
+				unknown = append(unknown, fmt.Sprintf("%s: uid %s is %q, use the name", name, u, known.Username))
+			}
+			continue
+		}
+		if _, err := user.Lookup(u); err != nil {
+			unknown = append(unknown, fmt.Sprintf("%s: user %q does not exist on this machine", name, u))
+		}
+	}
+	return unknown
+}
+
+func (config Config) BannedIP(allowMe string) bool {
+
+	return inIPList(allowMe, config.BadIPs) || inBlocklists(allowMe, config.Blocklists)
 
 }
 
 func (config Config) AllowedIP(allowMe string) bool {
-	for _, ip := range config.GoodIPs {
-		if strings.Contains(allowMe, ip) {
-			return true
-		}
+	if inIPList(allowMe, config.GoodIPs) {
+		return true
 	}
 
 	return allowMe == ""
@@ -62,7 +200,19 @@ func (config Config) AllowedUser(allowMe string) bool {
 
 }
 
+func (config Config) ProtectedExe(exe string) bool {
+	for _, protected := range config.ProtectedExes {
+		if exe == protected {
+			return true
+		}
+	}
+	return false
+}
+
 func (config Config) IsBonkable(allowMe string) bool {
+	if _, exists := config.Policies[allowMe]; exists {
+		return true
+	}
 	for _, key := range config.Bonkable {
 		if allowMe == key {
 			return true
@@ -70,3 +220,40 @@ func (config Config) IsBonkable(allowMe string) bool {
 	}
 	return false
 }
+
+// BonkableKeys lists every key from the bonkable list and the policies
+func (config Config) BonkableKeys() []string {
+	keys := append([]string{}, config.Bonkable...)
+	for key := range config.Policies {
+		if !config.inBonkableList(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys[len(config.Bonkable):])
+	return keys
+}
+
+func (config Config) inBonkableList(key string) bool {
+	for _, k := range config.Bonkable {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyFor returns the policy for a key. Keys that are only in the bonkable list get the old behaviour:
+// kill anyone not in allowed-user
+func (config Config) PolicyFor(key string) (Policy, bool) {
+	if policy, exists := config.Policies[key]; exists {
+		if policy.Action == "" {
+			policy.Action = ActionKill
+		}
+		policy.inheritUsers = policy.Users == nil
+		return policy, true
+	}
+	if config.inBonkableList(key) {
+		return Policy{Action: ActionKill, inheritUsers: true}, true
+	}
+	return Policy{}, false
+}
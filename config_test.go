@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, data string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	return config.Load(path)
+}
+
+func TestLoadIsStrict(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`{"allowed-users": ["root"]}`, `unknown field "allowed-users"`},
+		{`{"allowed-user": "root"}`, "cannot unmarshal string"},
+		{`{"policies": {"tracing": {"action": "kill", "allowed-users": ["root"]}}}`, `unknown field "allowed-users"`},
+		{`{"policies": {"tracing": {"allowed-exe": ["gdb"]}}}`, "not an absolute path"},
+		{`{"allowed-user": ["root"]} {"bonkable": []}`, "trailing data"},
+		{`{"allowed-user": ["root"],}`, "invalid character"},
+	}
+	for _, test := range tests {
+		err := loadTestConfig(t, test.data)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.data, err, test.want)
+		}
+	}
+
+	if err := loadTestConfig(t, `{"allowed-user": ["root"], "bonkable": ["tracing"]}`); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+}
+
+func TestDefaultConfigLoads(t *testing.T) {
+	data, err := res.ReadFile("embed/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTestConfig(t, string(data)); err != nil {
+		t.Errorf("embedded config does not load: %v", err)
+	}
+	// a fresh machine gets this one written out, bonk has to start with it
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	if err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs := config.Check(); len(errs) > 0 {
+		t.Errorf("embedded config has errors: %q", errs)
+	}
+}
+
+func TestCheckWarnings(t *testing.T) {
+	config := Config{
+		Users:    []string{"root", "unset", "no-such-user-here", "3999999999", "0"},
+		Bonkable: []string{"tracing", "tracing"},
+		Policies: map[string]Policy{"tracing": {Users: []string{"rooot"}}},
+	}
+	checked, errs := config.Check()
+	warnings := strings.Join(checked, "\n")
+	if !strings.Contains(warnings, `"tracing" is listed twice`) {
+		t.Errorf("missing the twice listed key in %q", warnings)
+	}
+
+	// a user that never matches gets bonked, that is an error and not a warning
+	got := strings.Join(errs, "\n")
+	for _, want := range []string{`allowed-user: user "no-such-user-here" does not exist`, `policy "tracing" allowed-user: user "rooot" does not exist`, `uid 0 is "root", use the name`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+	if len(errs) != 3 {
+		t.Errorf("root, unset and a uid without a user are fine, got %q", errs)
+	}
+
+	if warnings, _ := (Config{}).Check(); len(warnings) == 0 || !strings.Contains(warnings[0], "allowed-user is empty") {
+		t.Errorf("empty allowed-user not flagged: %q", warnings)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// the namespaces worth knowing about, /proc/<pid>/ns/<name>
+var namespaceNames = []string{"cgroup", "ipc", "mnt", "net", "pid", "user", "uts"}
+
+// containerPattern finds the 64 hex container id in the cgroup paths the runtimes use:
+//
+//	/docker/<id>                                docker (cgroupfs)
+//	/system.slice/docker-<id>.scope             docker (systemd)
+//	/kubepods.slice/.../cri-containerd-<id>.scope  containerd
+//	/kubepods.slice/.../crio-<id>.scope         cri-o
+//	/machine.slice/libpod-<id>.scope            podman
+var containerPattern = regexp.MustCompile(`(docker|cri-containerd|crio|libpod)[-/]([0-9a-f]{64})`)
+
+// the cgroup name prefix to the runtime behind it
+var containerRuntimes = map[string]string{
+	"docker":         "docker",
+	"cri-containerd": "containerd",
+	"crio":           "cri-o",
+	"libpod":         "podman",
+}
+
+// kubepodsPattern catches the cgroupfs kubelet layout (/kubepods/burstable/pod<uid>/<id>) where the runtime is not in the name
+var kubepodsPattern = regexp.MustCompile(`/kubepods[^ ]*/([0-9a-f]{64})`)
+
+// containerInfo is what an event is tagged with
+type containerInfo struct {
+	cgroup     string
+	id         string
+	runtime    string
+	namespaces map[string]string
+}
+
+// parseCgroup() picks the cgroup path out of /proc/<pid>/cgroup (the v2 line, or the first v1 line naming a container)
+// and the container id and runtime out of that path
+func parseCgroup(data string) (cgroup string, id string, runtime string) {
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		// hierarchy-ID:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		path := parts[2]
+		if m := containerPattern.FindStringSubmatch(path); m != nil {
+			return path, m[2], containerRuntimes[m[1]]
+		}
+		if m := kubepodsPattern.FindStringSubmatch(path); m != nil {
+			return path, m[1], "kubernetes"
+		}
+		if parts[0] == "0" {
+			cgroup = path
+		}
+	}
+	return cgroup, "", ""
+}
+
+// readNamespaces() reads the namespace inodes of a process, "net:[4026531840]" becomes "4026531840"
+func readNamespaces(pid int) map[string]string {
+	namespaces := make(map[string]string)
+	for _, name := range namespaceNames {
+		link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, name))
+		if err != nil {
+			continue
+		}
+		if i := strings.IndexByte(link, '['); i != -1 && strings.HasSuffix(link, "]") {
+			namespaces[name] = link[i+1 : len(link)-1]
+		}
+	}
+	return namespaces
+}
+
+// containerCache keeps the lookups per pid and start time, a process does not move between containers
+var containerCache = struct {
+	sync.Mutex
+	infos map[string]containerInfo
+}{infos: make(map[string]containerInfo)}
+
+// lookupContainer() resolves the container of a running process
+func lookupContainer(pid int) (containerInfo, error) {
+	start, err := procStartTime(pid)
+	if err != nil {
+		return containerInfo{}, err
+	}
+	id := fmt.Sprintf("%d/%s", pid, start)
+
+	containerCache.Lock()
+	info, cached := containerCache.infos[id]
+	containerCache.Unlock()
+	if cached {
+		return info, nil
+	}
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return containerInfo{}, err
+	}
+	info.cgroup, info.id, info.runtime = parseCgroup(string(data))
+	info.namespaces = readNamespaces(pid)
+
+	containerCache.Lock()
+	// pids get reused, so this only grows until it is thrown away
+	if len(containerCache.infos) > 4096 {
+		containerCache.infos = make(map[string]containerInfo)
+	}
+	containerCache.infos[id] = info
+	containerCache.Unlock()
+	return info, nil
+}
+
+// setContainer() tags the event with its cgroup, container and namespaces. Replayed pids are history, so those stay untagged
+func (a *AuditMessageBonk) setContainer() {
+	if a.Pid <= 0 || *mode == "replay" {
+		return
+	}
+	info, err := lookupContainer(a.Pid)
+	if err != nil {
+		return
+	}
+	a.Cgroup = info.cgroup
+	a.ContainerID = info.id
+	a.ContainerRuntime = info.runtime
+	a.Namespaces = info.namespaces
+}
+
+// InContainer says whether the event came from inside a container
+func (a AuditMessageBonk) InContainer() bool {
+	return a.ContainerID != ""
+}
+
+// shortID is the 12 character id docker ps shows
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const testContainerID = "4d2a7c1f0b9e8d3c6a5f4e3d2c1b0a9f8e7d6c5b4a39281706f5e4d3c2b1a098"
+
+func TestParseCgroup(t *testing.T) {
+	tests := []struct {
+		data    string
+		id      string
+		runtime string
+	}{
+		{"0::/system.slice/docker-" + testContainerID + ".scope\n", testContainerID, "docker"},
+		{"12:pids:/docker/" + testContainerID + "\n11:memory:/docker/" + testContainerID + "\n", testContainerID, "docker"},
+		{"0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice/cri-containerd-" + testContainerID + ".scope\n", testContainerID, "containerd"},
+		{"0::/kubepods.slice/kubepods-pod1234.slice/crio-" + testContainerID + ".scope\n", testContainerID, "cri-o"},
+		{"0::/machine.slice/libpod-" + testContainerID + ".scope/container\n", testContainerID, "podman"},
+		{"0::/kubepods/burstable/pod1234/" + testContainerID + "\n", testContainerID, "kubernetes"},
+		{"0::/user.slice/user-1000.slice/session-2.scope\n", "", ""},
+		{"0::/system.slice/docker.service\n", "", ""},
+	}
+	for _, test := range tests {
+		cgroup, id, runtime := parseCgroup(test.data)
+		if id != test.id || runtime != test.runtime {
+			t.Errorf("%q: got %q %q, want %q %q", test.data, id, runtime, test.id, test.runtime)
+		}
+		if cgroup == "" {
+			t.Errorf("%q: no cgroup", test.data)
+		}
+	}
+}
+
+func TestLookupContainerSelf(t *testing.T) {
+	info, err := lookupContainer(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.namespaces["net"] == "" || info.namespaces["pid"] == "" {
+		t.Errorf("namespaces %v", info.namespaces)
+	}
+}
+
+func TestContainerPolicy(t *testing.T) {
+	config := testConfig
+	config.Policies = map[string]Policy{
+		"priv_esc": {Action: ActionAlert, Users: []string{}, Container: &Policy{Action: ActionKill, Users: []string{}}},
+	}
+	killed, out := setupReceive(t, "bonk", config)
+
+	host := AuditMessageBonk{Pid: 93000100, Exe: "/usr/bin/sudo", Key: "priv_esc", AuidHumanReadable: "bob"}
+	contained := host
+	contained.Pid = 93000200
+	contained.ContainerID = testContainerID
+	contained.ContainerRuntime = "docker"
+
+	for _, a := range []AuditMessageBonk{host, contained} {
+		if _, err := bonkProc(a, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != 93000200 {
+		t.Errorf("killed %v, want only the one in the container", *killed)
+	}
+	if !strings.Contains(out.String(), "CONTAINER: docker/4d2a7c1f0b9e;") {
+		t.Errorf("no container in the log:\n%s", out.String())
+	}
+}
+
+func TestNestedContainerPolicy(t *testing.T) {
+	err := loadTestConfig(t, `{"policies": {"priv_esc": {"container": {"container": {"action": "kill"}}}}}`)
+	if err == nil || !strings.Contains(err.Error(), "can not have its own container policy") {
+		t.Errorf("got %v", err)
+	}
+	err = loadTestConfig(t, `{"policies": {"priv_esc": {"action": "alert", "container": {"action": "bonk"}}}}`)
+	if err == nil || !strings.Contains(err.Error(), `"priv_esc container": unknown action`) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	// one directory per audit event under here
+	EVIDENCEDIR = "/var/bonk/evidence"
+	// binaries bigger than this are hashed but not copied
+	EVIDENCEMAXEXE = 64 << 20
+)
+
+// evidenceDir is where bundles go, swapped out in tests
+var evidenceDir = EVIDENCEDIR
+
+// evidenceWG tracks the exe copies still being written, receive waits for them before it returns
+var evidenceWG sync.WaitGroup
+
+// evidenceBundle writes files into one bundle and remembers their sha256 for the manifest
+type evidenceBundle struct {
+	dir    string
+	sums   map[string]string
+	errors []string
+}
+
+// add() writes one file of the bundle
+func (b *evidenceBundle) add(name string, data []byte) {
+	if err := ioutil.WriteFile(filepath.Join(b.dir, name), data, 0600); err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%s: %s", name, err))
+		return
+	}
+	sum := sha256.Sum256(data)
+	b.sums[name] = hex.EncodeToString(sum[:])
+}
+
+// copyProc() copies a /proc/<pid> file as is
+func (b *evidenceBundle) copyProc(pid int, file string, name string) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/%s", pid, file))
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%s: %s", name, err))
+		return
+	}
+	b.add(name, data)
+}
+
+// copyExe() copies the binary through an open /proc/<pid>/exe, which works even when it was deleted from disk after starting,
+// and keeps working after the process is killed
+func (b *evidenceBundle) copyExe(src *os.File) {
+	defer src.Close()
+
+	h := sha256.New()
+	info, err := src.Stat()
+	if err == nil && info.Size() > EVIDENCEMAXEXE {
+		// too big to keep, the hash still says what it was
+		if _, err := io.Copy(h, src); err != nil {
+			b.errors = append(b.errors, fmt.Sprintf("exe: %s", err))
+			return
+		}
+		b.errors = append(b.errors, fmt.Sprintf("exe: %d bytes is over the %d byte limit, only hashed (sha256 %x)", info.Size(), EVIDENCEMAXEXE, h.Sum(nil)))
+		return
+	}
+
+	dst, err := os.OpenFile(filepath.Join(b.dir, "exe"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("exe: %s", err))
+		return
+	}
+	defer dst.Close()
+	if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("exe: %s", err))
+		return
+	}
+	b.sums["exe"] = hex.EncodeToString(h.Sum(nil))
+}
+
+// finish() writes errors.txt and the manifest, once everything else is in
+func (b *evidenceBundle) finish() error {
+	if len(b.errors) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"))
+	}
+
+	// sha256sum -c MANIFEST.sha256 checks the bundle
+	names := make([]string, 0, len(b.sums))
+	for name := range b.sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var manifest strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&manifest, "%s  %s\n", b.sums[name], name)
+	}
+	return ioutil.WriteFile(filepath.Join(b.dir, "MANIFEST.sha256"), []byte(manifest.String()), 0600)
+}
+
+// fdTargets() lists where every open fd points ("3 -> socket:[12345]")
+func fdTargets(pid int) ([]byte, error) {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fds, func(i, j int) bool {
+		a, _ := strconv.Atoi(fds[i].Name())
+		b, _ := strconv.Atoi(fds[j].Name())
+		return a < b
+	})
+	var out strings.Builder
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil {
+			target = "? " + err.Error()
+		}
+		fmt.Fprintf(&out, "%s -> %s\n", fd.Name(), target)
+	}
+	return []byte(out.String()), nil
+}
+
+// ancestry() walks up from pid to init, one "pid ppid exe cmdline" line per process
+func ancestry(pid int) []byte {
+	var out strings.Builder
+	for depth := 0; pid > 0 && depth < 64; depth++ {
+		ppid, err := parentPid(pid)
+		if err != nil {
+			fmt.Fprintf(&out, "%d ? gone\n", pid)
+			break
+		}
+		exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		fmt.Fprintf(&out, "%d %d %s %s\n", pid, ppid, exe, strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " ")))
+		pid = ppid
+	}
+	return []byte(out.String())
+}
+
+// bundleDir() creates a new directory for a bundle. Nothing is ever written into an existing one, where leftovers would
+// mix two incidents; a second bundle with the same name gets a -2, -3 ... suffix
+func bundleDir(name string) (string, error) {
+	if err := os.MkdirAll(evidenceDir, 0700); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(evidenceDir, name)
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			return dir, nil
+		}
+		if !os.IsExist(err) || n > 100 {
+			return "", err
+		}
+		dir = filepath.Join(evidenceDir, fmt.Sprintf("%s-%d", name, n))
+	}
+}
+
+// collectEvidence() snapshots a process into evidenceDir/<timestamp>-<auditID>/ before it gets bonked, with a sha256 manifest.
+// Whatever can not be read is listed in errors.txt instead of stopping the rest. The exe can be big, so it is copied in the
+// background from an fd opened here; the manifest is written once that is done (evidenceWG)
+func collectEvidence(a AuditMessageBonk) (string, error) {
+	// the serial starts over at every boot, only together with the timestamp does it name one incident
+	stamp, serial := a.Timestamp, a.AuditID
+	if stamp == "" {
+		now := time.Now()
+		stamp = fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/1e6)
+	}
+	if serial == "" {
+		serial = fmt.Sprintf("pid-%d", a.Pid)
+	}
+	dir, err := bundleDir(stamp + "-" + serial)
+	if err != nil {
+		return "", err
+	}
+	b := &evidenceBundle{dir: dir, sums: make(map[string]string)}
+
+	pid := a.Pid
+	for _, file := range []string{"cmdline", "environ", "status", "maps"} {
+		b.copyProc(pid, file, file)
+	}
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6", "unix"} {
+		b.copyProc(pid, "net/"+table, "net-"+table)
+	}
+
+	if fds, err := fdTargets(pid); err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("fd: %s", err))
+	} else {
+		b.add("fd", fds)
+	}
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("cwd: %s", err))
+	} else {
+		b.add("cwd", []byte(cwd+"\n"))
+	}
+	b.add("ancestry", ancestry(pid))
+	if event, err := json.MarshalIndent(a, "", "    "); err == nil {
+		b.add("event.json", event)
+	}
+
+	exe, err := os.Open(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("exe: %s", err))
+		return b.dir, b.finish()
+	}
+	evidenceWG.Add(1)
+	go func() {
+		defer evidenceWG.Done()
+		b.copyExe(exe)
+		if err := b.finish(); err != nil {
+			fmt.Printf("error> evidence for %d: %s\n", pid, err)
+		}
+	}()
+	return b.dir, nil
+}
+
+// gatherEvidence() stops the process and collects the bundle when -evidence is on, and logs where it went. The SIGSTOP
+// keeps it from changing (or cleaning up after itself) while it is snapshotted, the caller kills it right after.
+// Returns the bundle directory, or "" when there is none
+func gatherEvidence(a AuditMessageBonk) string {
+	if !*evidence || *mode != "bonk" {
+		return ""
+	}
+	if err := stopPid(a.Pid); err != nil {
+		fmt.Printf("error> stopping %d for evidence: %s\n", a.Pid, err)
+	}
+	dir, err := collectEvidence(a)
+	if err != nil {
+		fmt.Printf("error> evidence for %d: %s\n", a.Pid, err)
+		if dir == "" {
+			return ""
+		}
+	}
+	outMessage := fmt.Sprintf("[%s] %d %s saved to %s", color.CyanString("EVIDENCE"), a.Pid, a.Exe, dir)
+	CoolLogger.Println(outMessage)
+	if *verbose {
+		fmt.Println(outMessage)
+	}
+	return dir
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCollectEvidence(t *testing.T) {
+	old := evidenceDir
+	evidenceDir = t.TempDir()
+	t.Cleanup(func() { evidenceDir = old })
+	pid := startSleep(t)
+
+	dir, err := collectEvidence(AuditMessageBonk{Timestamp: "1364481363.243", AuditID: "24287", Pid: pid, Exe: "/bin/sleep", Key: "tracing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidenceWG.Wait()
+	if dir != filepath.Join(evidenceDir, "1364481363.243-24287") {
+		t.Errorf("bundle in %s", dir)
+	}
+
+	cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil || !strings.HasPrefix(string(cmdline), "sleep\x0030") {
+		t.Errorf("cmdline %q, %v", cmdline, err)
+	}
+	ancestry, _ := ioutil.ReadFile(filepath.Join(dir, "ancestry"))
+	if !strings.Contains(string(ancestry), strconv.Itoa(os.Getpid())) {
+		t.Errorf("ancestry is missing the test process:\n%s", ancestry)
+	}
+
+	// every file is in the manifest, and the manifest matches
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, "MANIFEST.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+		fields := strings.Fields(line)
+		data, err := ioutil.ReadFile(filepath.Join(dir, fields[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != fields[0] {
+			t.Errorf("%s does not match the manifest", fields[1])
+		}
+		listed[fields[1]] = true
+	}
+	for _, want := range []string{"cmdline", "environ", "status", "maps", "fd", "cwd", "net-tcp", "ancestry", "exe", "event.json"} {
+		if !listed[want] {
+			t.Errorf("%s missing from the manifest", want)
+		}
+	}
+}
+
+func TestEvidenceStopsBeforeKill(t *testing.T) {
+	_, out := setupReceive(t, "bonk", testConfig)
+	*evidence = true
+	old := evidenceDir
+	evidenceDir = t.TempDir()
+	t.Cleanup(func() { evidenceDir = old })
+	pid := startSleep(t)
+
+	var steps []string
+	oldStop := stopPid
+	stopPid = func(pid int) error {
+		steps = append(steps, "stop")
+		return syscall.Kill(pid, syscall.SIGSTOP)
+	}
+	t.Cleanup(func() { stopPid = oldStop })
+	killPid = func(pid int) error {
+		steps = append(steps, "kill")
+		return syscall.Kill(pid, syscall.SIGKILL)
+	}
+
+	if _, err := bonkProc(AuditMessageBonk{Timestamp: "1364481363.243", AuditID: "24288", Pid: pid, Exe: "/bin/sleep", Key: "tracing", AuidHumanReadable: "unset"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(steps, " "); got != "stop kill" {
+		t.Errorf("got %q, want stop before kill", got)
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("[EVIDENCE] %d /bin/sleep saved to", pid)) {
+		t.Errorf("no evidence line in:\n%s", out.String())
+	}
+
+	// the exe was still being copied when the process died, the open fd keeps it readable
+	evidenceWG.Wait()
+	manifest, err := ioutil.ReadFile(filepath.Join(evidenceDir, "1364481363.243-24288", "MANIFEST.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"  cmdline\n", "  exe\n"} {
+		if !strings.Contains(string(manifest), want) {
+			t.Errorf("%q missing from the manifest:\n%s", want, manifest)
+		}
+	}
+}
+
+func TestEvidenceNeverReusesABundle(t *testing.T) {
+	old := evidenceDir
+	evidenceDir = t.TempDir()
+	t.Cleanup(func() { evidenceDir = old })
+
+	// the same serial after a reboot, the old bundle still holds an exe this one will not have
+	stale := filepath.Join(evidenceDir, "1364481363.243-24287")
+	if err := os.Mkdir(stale, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(stale, "exe"), []byte("old incident"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := collectEvidence(AuditMessageBonk{Timestamp: "1364481363.243", AuditID: "24287", Pid: 94000999, Exe: "/bin/gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidenceWG.Wait()
+	if dir != stale+"-2" {
+		t.Errorf("bundle in %s, want %s-2", dir, stale)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "exe")); !os.IsNotExist(err) {
+		t.Errorf("exe in the new bundle: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(stale, "exe")); string(data) != "old incident" {
+		t.Errorf("old bundle was overwritten: %q", data)
+	}
+}
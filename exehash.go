@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// TrustedExe pins a binary by path *and* content, so copying it somewhere else or swapping it out does not get a pass
+type TrustedExe struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// fileID is what has to stay the same for a cached hash to still be good
+type fileID struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime int64
+}
+
+// exeHashes caches sha256 sums by inode and mtime so every event does not re-read the binary
+var exeHashes = struct {
+	sync.Mutex
+	sums map[fileID]string
+}{sums: make(map[fileID]string)}
+
+// hashFile() returns the sha256 of a file, from the cache when the file has not changed
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no inode for %s", path)
+	}
+	id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino), size: info.Size(), mtime: info.ModTime().UnixNano()}
+
+	exeHashes.Lock()
+	sum, cached := exeHashes.sums[id]
+	exeHashes.Unlock()
+	if cached {
+		return sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	exeHashes.Lock()
+	exeHashes.sums[id] = sum
+	exeHashes.Unlock()
+
+	return sum, nil
+}
+
+// exeFile() is the file to hash for an event. /proc/<pid>/exe is the binary that is actually running
+// even if the path got swapped, the recorded path is the fallback once the process is gone
+func exeFile(a AuditMessageBonk) string {
+	if *mode != "replay" && a.Pid > 0 {
+		procExe := "/proc/" + strconv.Itoa(a.Pid) + "/exe"
+		if target, err := os.Readlink(procExe); err == nil && strings.TrimSuffix(target, " (deleted)") == a.Exe {
+			return procExe
+		}
+	}
+	return a.Exe
+}
+
+// TrustedExe says whether the event's exe is pinned and still hashes to the pinned value
+func (config Config) TrustedExe(a AuditMessageBonk) (bool, error) {
+	for _, trusted := range config.TrustedExes {
+		if trusted.Path != a.Exe {
+			continue
+		}
+
+		sum, err := hashFile(exeFile(a))
+		if err != nil {
+			return false, err
+		}
+		if !strings.EqualFold(sum, trusted.SHA256) {
+			return false, fmt.Errorf("%s does not match its pinned sha256 (got %s)", a.Exe, sum)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func validSHA256(sum string) bool {
+	b, err := hex.DecodeString(sum)
+	return err == nil && len(b) == sha256.Size
+}
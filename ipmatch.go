@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipRange is one banned-ips/allowed-ips entry, first and last inclusive, both in 16 byte form so
+// IPv4 and v4-mapped IPv6 addresses compare the same
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// parseIPEntry() reads "10.0.0.1", "10.0.0.0/8", "2001:db8::/32" or "10.0.0.1-10.0.0.20"
+func parseIPEntry(entry string) (ipRange, error) {
+	entry = strings.TrimSpace(entry)
+
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return ipRange{}, fmt.Errorf("bad CIDR %q", entry)
+		}
+		first := ipnet.IP.To16()
+		last := make(net.IP, len(first))
+		// the mask is 4 bytes for IPv4, line it up with the end of the 16 byte address
+		offset := len(first) - len(ipnet.Mask)
+		for i := range first {
+			last[i] = first[i]
+			if i >= offset {
+				last[i] |= ^ipnet.Mask[i-offset]
+			}
+		}
+		return ipRange{first: first, last: last}, nil
+	}
+
+	if i := strings.Index(entry, "-"); i != -1 {
+		first, last := net.ParseIP(strings.TrimSpace(entry[:i])), net.ParseIP(strings.TrimSpace(entry[i+1:]))
+		if first == nil || last == nil {
+			return ipRange{}, fmt.Errorf("bad range %q", entry)
+		}
+		if (first.To4() == nil) != (last.To4() == nil) {
+			return ipRange{}, fmt.Errorf("range %q mixes IPv4 and IPv6", entry)
+		}
+		if bytes.Compare(first.To16(), last.To16()) > 0 {
+			return ipRange{}, fmt.Errorf("range %q ends before it starts", entry)
+		}
+		return ipRange{first: first.To16(), last: last.To16()}, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return ipRange{}, fmt.Errorf("bad IP address %q", entry)
+	}
+	return ipRange{first: ip.To16(), last: ip.To16()}, nil
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+// parseIPList() checks every entry of an IP list. Empty entries (the old default config shipped [""]) are skipped, they match nothing
+func parseIPList(name string, entries []string) ([]ipRange, error) {
+	var ranges []ipRange
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		r, err := parseIPEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// inIPList() says whether ip falls in any of the entries. Entries that do not parse never match, Load refuses them anyway
+func inIPList(ip string, entries []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		r, err := parseIPEntry(entry)
+		if err != nil {
+			continue
+		}
+		if r.contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
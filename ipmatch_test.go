@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIPListsMatchCIDRAndRanges(t *testing.T) {
+	config := Config{BadIPs: []string{"10.0.0.1", "192.168.0.0/16", "172.16.0.10-172.16.0.20", "2001:db8::/32", ""}}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		// the old substring match banned this one
+		{"110.0.0.15", false},
+		{"10.0.0.10", false},
+		{"192.168.44.1", true},
+		{"192.169.0.1", false},
+		{"172.16.0.10", true},
+		{"172.16.0.20", true},
+		{"172.16.0.21", false},
+		{"::ffff:192.168.1.1", true},
+		{"2001:db8:1::5", true},
+		{"2001:db9::5", false},
+		{"not an ip", false},
+	}
+	for _, test := range tests {
+		if got := config.BannedIP(test.ip); got != test.want {
+			t.Errorf("BannedIP(%q) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestEmptyIPEntryMatchesNothing(t *testing.T) {
+	config := Config{BadIPs: []string{""}, GoodIPs: []string{""}}
+
+	if config.BannedIP("203.0.113.7") {
+		t.Error("empty banned-ips entry banned everything")
+	}
+	if config.AllowedIP("203.0.113.7") {
+		t.Error("empty allowed-ips entry allowed everything")
+	}
+}
+
+func TestParseIPListRejectsBadEntries(t *testing.T) {
+	for _, entry := range []string{"10.0.0", "10.0.0.0/33", "10.0.0.9-10.0.0.1", "10.0.0.1-2001:db8::1", "10.0.0.1-"} {
+		_, err := parseIPList("banned-ips", []string{entry})
+		if err == nil {
+			t.Errorf("%q was accepted", entry)
+		} else if !strings.HasPrefix(err.Error(), "banned-ips:") {
+			t.Errorf("error %q does not name the list", err)
+		}
+	}
+}
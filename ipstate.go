@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ipStatePath is where the IP state lives, swapped out in tests
+var ipStatePath = IPSTATEPATH
+
+// ipRecord is what bonk remembers about a remote IP between restarts
+type ipRecord struct {
+	// offenses since the last -warn, halved every -decay without a new one
+	Count int `json:"count"`
+	// every offense ever, never decays
+	Total     int       `json:"total"`
+	FirstSeen time.Time `json:"first-seen"`
+	LastSeen  time.Time `json:"last-seen"`
+	// key -> how many times it fired with this IP attached
+	Keys map[string]int `json:"keys"`
+}
+
+// decay() halves the count once for every -decay period since the last offense
+func (r *ipRecord) decay(now time.Time, period time.Duration) {
+	if period <= 0 || r.Count == 0 {
+		return
+	}
+	periods := now.Sub(r.LastSeen) / period
+	if periods >= 63 {
+		r.Count = 0
+		return
+	}
+	if periods > 0 {
+		r.Count >>= uint(periods)
+	}
+}
+
+// offend() counts one offense of key, returns the count after decay
+func (r *ipRecord) offend(key string, now time.Time, period time.Duration) int {
+	r.decay(now, period)
+	if r.FirstSeen.IsZero() {
+		r.FirstSeen = now
+	}
+	if r.Keys == nil {
+		r.Keys = make(map[string]int)
+	}
+	r.Count++
+	r.Total++
+	r.LastSeen = now
+	r.Keys[key]++
+	return r.Count
+}
+
+// loadIPState() reads the IP state file. A missing file is a clean start, not an error.
+// Records that decayed to nothing and have been quiet for a week of -decay periods are dropped
+func loadIPState(path string, now time.Time, period time.Duration) (map[string]*ipRecord, error) {
+	state := make(map[string]*ipRecord)
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return make(map[string]*ipRecord), err
+	}
+
+	for ip, record := range state {
+		if record == nil {
+			delete(state, ip)
+			continue
+		}
+		// decay a copy, the record itself decays on its next offense from its own LastSeen. Decaying it here
+		// as well would halve it twice for the same periods
+		decayed := *record
+		decayed.decay(now, period)
+		if decayed.Count == 0 && period > 0 && now.Sub(record.LastSeen) > 7*period {
+			delete(state, ip)
+		}
+	}
+	return state, nil
+}
+
+// saveIPState() writes the state to a temp file and renames it over the old one, so a crash never leaves half a file
+func saveIPState(path string, state map[string]*ipRecord) error {
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".ips-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
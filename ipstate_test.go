@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPRecordDecays(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	r := &ipRecord{}
+	for i := 0; i < 8; i++ {
+		r.offend("tracing", start, time.Hour)
+	}
+
+	// two quiet hours halve it twice, then the new offense counts
+	if got := r.offend("sshd", start.Add(2*time.Hour), time.Hour); got != 3 {
+		t.Errorf("count = %d, want 3", got)
+	}
+	if r.Total != 9 || r.Keys["tracing"] != 8 || r.Keys["sshd"] != 1 {
+		t.Errorf("got %+v", r)
+	}
+	if !r.FirstSeen.Equal(start) || !r.LastSeen.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("first/last seen wrong: %+v", r)
+	}
+}
+
+func TestIPStateSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ips.json")
+	now := time.Unix(1000000, 0).UTC()
+
+	state := map[string]*ipRecord{
+		"203.0.113.7": {Count: 4, Total: 4, FirstSeen: now, LastSeen: now, Keys: map[string]int{"tracing": 4}},
+		// long forgotten
+		"198.51.100.1": {Count: 1, Total: 1, FirstSeen: now.Add(-30 * 24 * time.Hour), LastSeen: now.Add(-30 * 24 * time.Hour)},
+	}
+	if err := saveIPState(path, state); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadIPState(path, now, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("got %d records, want the stale one dropped", len(loaded))
+	}
+	record := loaded["203.0.113.7"]
+	if record == nil || record.Count != 4 || record.Keys["tracing"] != 4 {
+		t.Errorf("got %+v", record)
+	}
+}
+
+func TestLoadIPStateMissingFile(t *testing.T) {
+	state, err := loadIPState(filepath.Join(t.TempDir(), "nope.json"), time.Now(), time.Hour)
+	if err != nil || len(state) != 0 {
+		t.Errorf("got %v, %v, want an empty state", state, err)
+	}
+}
+
+func TestIPStateDecaysOnceAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ips.json")
+	now := time.Unix(1000000, 0).UTC()
+	period := 24 * time.Hour
+	lastSeen := now.Add(-2 * period)
+
+	if err := saveIPState(path, map[string]*ipRecord{
+		"203.0.113.7": {Count: 8, Total: 8, FirstSeen: lastSeen, LastSeen: lastSeen, Keys: map[string]int{"tracing": 8}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadIPState(path, now, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 8 halved twice, plus this one. The same as if bonk had never restarted
+	inMemory := &ipRecord{Count: 8, LastSeen: lastSeen}
+	want := inMemory.offend("tracing", now, period)
+	if got := loaded["203.0.113.7"].offend("tracing", now, period); got != want || got != 3 {
+		t.Errorf("got %d after restart, want %d", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/elastic/go-libaudit/rule"
+	"github.com/elastic/go-libaudit/rule/flags"
+	"github.com/fatih/color"
+)
+
+// lintResult holds everything lint found. errors are things that will break or silently never bonk,
+// warnings are things that probably are not what was meant
+type lintResult struct {
+	errors   []string
+	warnings []string
+	infos    []string
+}
+
+func (l *lintResult) errorf(format string, a ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, a...))
+}
+
+func (l *lintResult) warnf(format string, a ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, a...))
+}
+
+func (l *lintResult) infof(format string, a ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, a...))
+}
+
+// ruleDetails() pulls the keys and watched paths out of a parsed rule. emits is false for rules that never log anything
+func ruleDetails(ru rule.Rule) (keys []string, paths []string, emits bool) {
+	switch r := ru.(type) {
+	case *rule.FileWatchRule:
+		return r.Keys, []string{r.Path}, true
+	case *rule.SyscallRule:
+		keys = append(keys, r.Keys...)
+		for _, filter := range r.Filters {
+			switch filter.LHS {
+			case "key":
+				keys = append(keys, filter.RHS)
+			case "path", "dir":
+				paths = append(paths, filter.RHS)
+			}
+		}
+		return keys, paths, r.Action != "never"
+	}
+	return nil, nil, false
+}
+
+// lintRules() runs the rules through the same parser and builder load uses, without a kernel
+func lintRules(rules []ruleLine) lintResult {
+	var result lintResult
+
+	seen := make(map[string]ruleLine)    // canonical rule -> first place it showed up
+	emitted := make(map[string]ruleLine) // key -> first rule that logs it
+
+	for _, r := range rules {
+		ru, err := flags.Parse(r.Rule)
+		if err != nil {
+			result.errorf("%s parse error: %s\n\t%s", r, err, r.Rule)
+			continue
+		}
+		wf, err := rule.Build(ru)
+		if err != nil {
+			result.errorf("%s build error: %s\n\t%s", r, err, r.Rule)
+			continue
+		}
+
+		if canonical, err := canonicalRule(wf); err == nil {
+			if first, dup := seen[canonical]; dup {
+				result.warnf("%s duplicate of %s\n\t%s", r, first, r.Rule)
+			} else {
+				seen[canonical] = r
+			}
+		}
+
+		keys, paths, emits := ruleDetails(ru)
+
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				result.warnf("%s watches %s which does not exist\n\t%s", r, path, r.Rule)
+			}
+		}
+
+		inRule := make(map[string]bool)
+		for _, key := range keys {
+			if inRule[key] {
+				result.warnf("%s key %q given twice\n\t%s", r, key, r.Rule)
+			}
+			inRule[key] = true
+
+			if !emits {
+				continue
+			}
+			if _, ok := emitted[key]; !ok {
+				emitted[key] = r
+				if !cf.IsBonkable(key) {
+					result.infof("%s key %q is not bonkable, it will only be logged", r, key)
+				}
+			}
+		}
+	}
+
+	// a bonkable key without a rule behind it means that attack never gets bonked
+	for _, key := range cf.BonkableKeys() {
+		if _, ok := emitted[key]; !ok {
+			result.errorf("%s bonkable key %q is never emitted by any rule", configFile(), key)
+		}
+	}
+
+	return result
+}
+
+// mode=lint : checks every rule bonk would load (plus any extra files given) before the kernel sees them
+func lint(extraFiles []string) error {
+	rules, err := wantedRules()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range extraFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		fileRules, err := readRules(f, file)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	result := lintRules(rules)
+
+	if *showInfo {
+		for _, msg := range result.infos {
+			fmt.Printf("[%s] %s\n", color.BlueString("INFO"), msg)
+		}
+	}
+	for _, msg := range result.warnings {
+		fmt.Printf("[%s] %s\n", color.HiYellowString("WARN"), msg)
+	}
+	for _, msg := range result.errors {
+		fmt.Printf("[%s] %s\n", color.RedString("ERROR"), msg)
+	}
+	fmt.Printf("[!] linted %d rules: %d errors, %d warnings\n", len(rules), len(result.errors), len(result.warnings))
+
+	if len(result.errors) > 0 {
+		return fmt.Errorf("lint found %d errors", len(result.errors))
+	}
+	return nil
+}
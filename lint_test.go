@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintRules(t *testing.T) {
+	setupReceive(t, "lint", Config{Bonkable: []string{"tracing", "tpyo"}})
+
+	result := lintRules([]ruleLine{
+		{Rule: "-a always,exit -F arch=b64 -S ptrace -k tracing", Source: "a.rules", Line: 1},
+		{Rule: "-a always,exit -F arch=b64 -S ptrace -k tracing", Source: "a.rules", Line: 2},
+		{Rule: "-w /does/not/exist -p wa -k missing", Source: "a.rules", Line: 3},
+		{Rule: "-w /etc -p wa -key etc", Source: "b.rules", Line: 7},
+		{Rule: "-a never,exit -F arch=b64 -S open -k tpyo", Source: "b.rules", Line: 8},
+	})
+
+	expect := func(kind string, msgs []string, want string) {
+		t.Helper()
+		for _, msg := range msgs {
+			if strings.Contains(msg, want) {
+				return
+			}
+		}
+		t.Errorf("no %s containing %q in %q", kind, want, msgs)
+	}
+
+	expect("error", result.errors, "b.rules:7 parse error")
+	expect("error", result.errors, `bonkable key "tpyo" is never emitted`)
+	expect("warning", result.warnings, "a.rules:2 duplicate of a.rules:1")
+	expect("warning", result.warnings, "a.rules:3 watches /does/not/exist")
+	expect("info", result.infos, `key "missing" is not bonkable`)
+
+	if len(result.errors) != 2 {
+		t.Errorf("got %d errors, want 2: %q", len(result.errors), result.errors)
+	}
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	// "strings"
+	"unsafe"
 )
 
 const (
@@ -29,53 +35,139 @@ const (
 
 // inspiration from https://blog.arkey.fr/2020/10/23/read-network-addresses-in-procfs/
 
-func reverse(s []string) []string {
-	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
-		s[i], s[j] = s[j], s[i]
+// the addresses in /proc/net/tcp* are printed as 32 bit words in host byte order
+var hostEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&x))[0] == 0 {
+		hostEndian = binary.BigEndian
 	}
-	return s
 }
 
-func parseHexIP(raw string) string {
+// parseHexIP() turns the hex address from /proc/net/tcp (8 characters) or /proc/net/tcp6 (32 characters) into an IP.
+// v4-mapped IPv6 addresses come back as plain IPv4 so they match the same lists
+func parseHexIP(raw string) (string, error) {
+	b, err := hex.DecodeString(raw)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return "", fmt.Errorf("bad address length %d in %q", len(b), raw)
+	}
+
+	// flip every word back into network byte order
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], hostEndian.Uint32(b[i:]))
+	}
 
-	var octets []string
-	var sb strings.Builder
-	for _, d := range raw {
-		if len(sb.String()) == 1 {
-			sb.WriteString(string(d))
-			octets = append(octets, sb.String())
-			sb.Reset()
-		} else {
-			sb.WriteRune(d)
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String(), nil
+	}
+	return ip.String(), nil
+}
+
+// how far up the process tree getIPfromPID looks for a connection
+const maxSocketAncestors = 8
+
+// getIPfromPID() returns the remote addresses of the connections the process itself owns. /proc/<pid>/net/* lists
+// every socket in the network namespace, so only the ones whose inode shows up in /proc/<pid>/fd count.
+// A process without a connection of its own (the curl in a reverse shell) is blamed on the closest ancestor that has one (the shell, sshd)
+func getIPfromPID(pid int) (map[string]int, error) {
+	ipAddresses := make(map[string]int)
+
+	for depth := 0; pid > 1 && depth <= maxSocketAncestors; depth++ {
+		inodes, err := socketInodes(pid)
+		if err != nil {
+			// the process is gone
+			if depth == 0 {
+				return nil, nil
+			}
+			break
+		}
+
+		if len(inodes) > 0 {
+			for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+				file2open := fmt.Sprintf("/proc/%s/net/%s", strconv.Itoa(pid), table)
+				readSocketTable(file2open, inodes, ipAddresses)
+			}
+			if len(ipAddresses) > 0 {
+				return ipAddresses, nil
+			}
+		}
+
+		if pid, err = parentPid(pid); err != nil {
+			break
 		}
 	}
 
-	revOctets := reverse(octets)
+	return ipAddresses, nil
+
+}
 
-	var ipAddr strings.Builder
-	for _, oct := range revOctets {
-		o, _ := hex.DecodeString(oct)
-		// fmt.Printf("%d\n", o)
-		a := fmt.Sprintf("%d", o[len(o)-1])
-		ipAddr.WriteString(a)
-		ipAddr.WriteString(".")
+// lookupIPs() is getIPfromPID() as a sorted list, swapped out in tests like killPid. Replayed pids are history, so they have none
+var lookupIPs = func(pid int) []string {
+	if *mode == "replay" {
+		return nil
+	}
+	found, err := getIPfromPID(pid)
+	if err != nil && *verbose {
+		fmt.Printf("error> %v\n", err)
+	}
+	ips := make([]string, 0, len(found))
+	for ip := range found {
+		ips = append(ips, ip)
 	}
-	// val := ipAddr.String()
-	// fmt.Println(val)
-	// fmt.Println(ipAddr)
-	val := ipAddr.String()
-	actual := val[:len(val)-1]
-	return actual
+	sort.Strings(ips)
+	return ips
 }
 
-func getIPfromPID(pid int) (map[string]int, error) {
-	// open this file
-	pid2str := strconv.Itoa(pid)
-	file2open := fmt.Sprintf("/proc/%s/net/tcp", pid2str)
+// socketInodes() lists the inodes of the sockets a process has open ("socket:[12345]" links in /proc/<pid>/fd)
+func socketInodes(pid int) (map[string]bool, error) {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
 
-	file, err := os.Open(file2open)
+	inodes := make(map[string]bool)
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(target, "socket:[") && strings.HasSuffix(target, "]") {
+			inodes[target[len("socket:["):len(target)-1]] = true
+		}
+	}
+	return inodes, nil
+}
+
+// parentPid() reads the ppid out of /proc/<pid>/stat. comm can have spaces and parens in it, so split after the last ')'
+func parentPid(pid int) (int, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
 	if err != nil {
-		return nil, nil
+		return 0, err
+	}
+	end := bytes.LastIndexByte(data, ')')
+	if end == -1 {
+		return 0, fmt.Errorf("bad stat for %d", pid)
+	}
+	// ") S 1234 ..." state then ppid
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("bad stat for %d", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// readSocketTable() adds the remote addresses of the established sockets in one /proc/net/{tcp,udp}* file
+// that belong to one of the inodes
+func readSocketTable(path string, inodes map[string]bool, ipAddresses map[string]int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
 	}
 	defer file.Close()
 
@@ -83,44 +175,49 @@ func getIPfromPID(pid int) (map[string]int, error) {
 	scanner.Split(bufio.ScanLines)
 	counter := 0
 	// read through it
-	ipAddresses := make(map[string]int)
 	for scanner.Scan() {
-		text := scanner.Text()
+		fields := strings.Fields(scanner.Text())
 		// ignore header
-		if counter != 0 {
-			// some error handling. If the line is wacky make sure to break and not touch the following lines
-			if len(text) < 38 {
-				break
-			}
-			// this should catch reading from slice willy nilly
-			defer func() {
-				if err := recover(); err != nil {
-					log.Println("panic occurred:", err)
-				}
-			}()
-			// get remote address
-			REMADDR := text[20:28]
-			TCPStateStr := text[35:36]
-			lower := strings.ToLower(TCPStateStr)
-			TCPStateInt, _ := strconv.ParseInt(lower, 16, 64)
-
-			data := parseHexIP(REMADDR)
-			_ = data
-
-			// only care about established TCP connections
-			if TCPStateInt == TCP_ESTABLISHED {
-				if _, exist := ipAddresses[data]; exist {
-					ipAddresses[data] += 1
-				} else {
-					ipAddresses[data] = 0
-				}
-			}
+		if counter == 0 {
+			counter++
+			continue
+		}
+		counter++
 
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+		if len(fields) < 10 {
+			continue
 		}
 
-		counter++
-	}
+		// not one of ours
+		if !inodes[fields[9]] {
+			continue
+		}
 
-	return ipAddresses, nil
+		// get remote address
+		remote := strings.SplitN(fields[2], ":", 2)
+		TCPStateInt, err := strconv.ParseInt(fields[3], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		// only care about established connections (connected udp sockets report the same state)
+		if TCPStateInt != TCP_ESTABLISHED {
+			continue
+		}
+
+		data, err := parseHexIP(remote[0])
+		if err != nil {
+			log.Println("bad address:", err)
+			continue
+		}
+
+		if _, exist := ipAddresses[data]; exist {
+			ipAddresses[data] += 1
+		} else {
+			ipAddresses[data] = 0
+		}
+	}
 
+	return scanner.Err()
 }
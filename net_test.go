@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// procHex writes an IP the way the kernel prints it in /proc/net/tcp*
+func procHex(t *testing.T, ip string, v6 bool) string {
+	t.Helper()
+	parsed := net.ParseIP(ip)
+	if !v6 {
+		parsed = parsed.To4()
+	}
+	var sb strings.Builder
+	for i := 0; i < len(parsed); i += 4 {
+		word := make([]byte, 4)
+		hostEndian.PutUint32(word, binary.BigEndian.Uint32(parsed[i:]))
+		fmt.Fprintf(&sb, "%02X%02X%02X%02X", word[0], word[1], word[2], word[3])
+	}
+	return sb.String()
+}
+
+func TestParseHexIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		v6   bool
+		want string
+	}{
+		{"127.0.0.1", false, "127.0.0.1"},
+		{"10.20.30.40", false, "10.20.30.40"},
+		{"2001:db8::1", true, "2001:db8::1"},
+		{"::ffff:192.168.1.9", true, "192.168.1.9"},
+		{"::1", true, "::1"},
+	}
+	for _, tt := range tests {
+		got, err := parseHexIP(procHex(t, tt.ip, tt.v6))
+		if err != nil || got != tt.want {
+			t.Errorf("parseHexIP(%s) = %q, %v, want %q", tt.ip, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseHexIP("0100"); err == nil {
+		t.Error("short address did not error")
+	}
+}
+
+func TestReadSocketTable(t *testing.T) {
+	dir := t.TempDir()
+	tcp6 := "  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		fmt.Sprintf("   0: %s:0016 %s:D431 01 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 20 4 1 10 -1\n", procHex(t, "2001:db8::2", true), procHex(t, "2001:db8::bad", true)) +
+		fmt.Sprintf("   1: %s:0016 %s:D432 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 20 4 1 10 -1\n", procHex(t, "::ffff:10.0.0.2", true), procHex(t, "::ffff:10.0.0.66", true)) +
+		fmt.Sprintf("   2: %s:0016 %s:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 1 10 -1\n", procHex(t, "::", true), procHex(t, "::", true))
+	path := filepath.Join(dir, "tcp6")
+	if err := ioutil.WriteFile(path, []byte(tcp6), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ips := make(map[string]int)
+	if err := readSocketTable(path, map[string]bool{"1001": true, "1002": true, "1003": true}, ips); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 2 {
+		t.Errorf("got %v, want the two established remotes", ips)
+	}
+
+	// sockets owned by someone else in the namespace do not count
+	theirs := make(map[string]int)
+	if err := readSocketTable(path, map[string]bool{"1002": true}, theirs); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := theirs["2001:db8::bad"]; ok || len(theirs) != 1 {
+		t.Errorf("got %v, want only 10.0.0.66", theirs)
+	}
+	for _, want := range []string{"2001:db8::bad", "10.0.0.66"} {
+		if _, ok := ips[want]; !ok {
+			t.Errorf("missing %s in %v", want, ips)
+		}
+	}
+}
+
+func TestIPListsMatchIPv6(t *testing.T) {
+	config := Config{BadIPs: []string{"2001:0db8:0:0::bad", "10.0.0.66"}, GoodIPs: []string{"fe80::1"}}
+
+	if !config.BannedIP("2001:db8::bad") {
+		t.Error("expanded IPv6 entry did not match")
+	}
+	if !config.BannedIP("::ffff:10.0.0.66") {
+		t.Error("v4-mapped address did not match its IPv4 entry")
+	}
+	if !config.AllowedIP("fe80::1") || config.AllowedIP("fe80::2") {
+		t.Error("IPv6 allow list is wrong")
+	}
+}
+
+func TestGetIPfromPIDOwnSockets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	// both ends are ours, so 127.0.0.1 has to show up
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ips, err := getIPfromPID(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ips["127.0.0.1"]; !ok {
+		t.Errorf("own connection missing from %v", ips)
+	}
+
+	if ppid, err := parentPid(os.Getpid()); err != nil || ppid != os.Getppid() {
+		t.Errorf("parentPid = %d, %v, want %d", ppid, err, os.Getppid())
+	}
+}
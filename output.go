@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// JSONLogger gets one JSON object per decision with -format=json
+var JSONLogger = log.New(io.Discard, "", 0)
+
+// decision is a single bonkProc verdict in a form a SIEM can read
+type decision struct {
+	Time     string           `json:"time"`
+	Verdict  string           `json:"verdict"` // BONK, STOP, LOG, ALERT, COOL, INFO, STRIKE, DENY-IP, ALLOW-IP, ALLOW-EXE
+	Mode     string           `json:"mode"`
+	Action   string           `json:"action,omitempty"`   // what the policy asked for (kill, stop, log, alert)
+	Result   string           `json:"result,omitempty"`   // ok, honk (not done), or the error from doing it
+	IPs      []string         `json:"ips,omitempty"`      // established connections of the process
+	Scope    string           `json:"scope,omitempty"`    // how far the action reached (policy scope)
+	PIDs     []int            `json:"pids,omitempty"`     // every pid the action was actually done to
+	Skipped  []string         `json:"skipped,omitempty"`  // pids in the scope left alone, and why
+	Evidence string           `json:"evidence,omitempty"` // evidence bundle taken before the kill
+	Event    AuditMessageBonk `json:"event"`
+}
+
+// newDecision() takes the IPs as they were before anything was done to the process, a killed process has no connections left
+func newDecision(verdict string, a AuditMessageBonk, ips []string, action string, result string) decision {
+	return decision{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Verdict: verdict,
+		Mode:    *mode,
+		Action:  action,
+		Result:  result,
+		IPs:     ips,
+		Event:   a,
+	}
+}
+
+// logLine is how the other bonk.log lines (EVIDENCE, BLOCK, RELOAD, BLOCKLIST, WARN ...) are written with -format=json
+type logLine struct {
+	Time    string `json:"time"`
+	Label   string `json:"label,omitempty"`
+	Message string `json:"message"`
+}
+
+var (
+	ansiEscape  = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	labelPrefix = regexp.MustCompile(`^\[([^\]]+)\]\s*`)
+)
+
+// jsonLines is CoolLogger's output with -format=json: every text line becomes a logLine on JSONLogger, so bonk.log stays one JSON object per line
+type jsonLines struct{}
+
+func (jsonLines) Write(p []byte) (int, error) {
+	text := strings.TrimSpace(ansiEscape.ReplaceAllString(string(p), ""))
+	entry := logLine{Time: time.Now().UTC().Format(time.RFC3339Nano), Message: text}
+	if m := labelPrefix.FindStringSubmatch(text); m != nil {
+		entry.Label = m[1]
+		entry.Message = text[len(m[0]):]
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	JSONLogger.Println(string(line))
+	return len(p), nil
+}
+
+// actionResult turns the error from kill/stop into the result field
+func actionResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// report() writes a decision out. bonk.log gets the colored line or the JSON object depending on -format,
+// stdout gets the colored line with -v (or always when loud). Repeats of prev are dropped
+func report(d decision, outMessage string, prev string, loud bool) {
+	if outMessage == prev {
+		return
+	}
+
+	if *format == "json" {
+		line, err := json.Marshal(d)
+		if err != nil {
+			fmt.Printf("error> %s\n", err)
+		} else {
+			JSONLogger.Println(string(line))
+		}
+	} else {
+		CoolLogger.Println(outMessage)
+	}
+
+	if *verbose || loud {
+		fmt.Println(outMessage)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestJSONDecisions(t *testing.T) {
+	killed, out := setupReceive(t, "bonk", testConfig)
+	*format = "json"
+	jsonOut := &bytes.Buffer{}
+	JSONLogger = log.New(jsonOut, "", 0)
+	t.Cleanup(func() {
+		*format = "text"
+		JSONLogger = log.New(io.Discard, "", 0)
+	})
+
+	bonkProc(AuditMessageBonk{Key: "tracing", AuidHumanReadable: "bob", Exe: "/usr/bin/gdb", Pid: testPid}, "")
+	bonkProc(AuditMessageBonk{Key: "tracing", AuidHumanReadable: "root", Exe: "/usr/bin/gdb", Pid: testPid}, "")
+
+	if out.Len() != 0 {
+		t.Errorf("text log got written in json mode: %q", out.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(jsonOut.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d json lines, want 2: %q", len(lines), jsonOut.String())
+	}
+
+	var bonk, cool decision
+	if err := json.Unmarshal([]byte(lines[0]), &bonk); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &cool); err != nil {
+		t.Fatal(err)
+	}
+
+	if bonk.Verdict != "BONK" || bonk.Action != ActionKill || bonk.Result != "ok" || bonk.Event.Pid != testPid || bonk.Event.Key != "tracing" {
+		t.Errorf("bad bonk decision %+v", bonk)
+	}
+	if cool.Verdict != "COOL" || cool.Action != "" || cool.Event.AuidHumanReadable != "root" {
+		t.Errorf("bad cool decision %+v", cool)
+	}
+	if strings.Contains(jsonOut.String(), "\x1b[") {
+		t.Error("json output has ANSI escapes in it")
+	}
+	if len(*killed) != 1 {
+		t.Errorf("killed %v, want one", *killed)
+	}
+}
+
+func TestJSONDecisionIPsBeforeKill(t *testing.T) {
+	killed, _ := setupReceive(t, "bonk", testConfig)
+	*format = "json"
+	jsonOut := &bytes.Buffer{}
+	JSONLogger = log.New(jsonOut, "", 0)
+	oldLookup := lookupIPs
+	t.Cleanup(func() {
+		*format = "text"
+		JSONLogger = log.New(io.Discard, "", 0)
+		lookupIPs = oldLookup
+	})
+	// the connections are gone once the process is
+	lookupIPs = func(pid int) []string {
+		if len(*killed) > 0 {
+			return nil
+		}
+		return []string{"203.0.113.7"}
+	}
+
+	bonkProc(AuditMessageBonk{Key: "tracing", AuidHumanReadable: "bob", Exe: "/usr/bin/gdb", Pid: testPid}, "")
+
+	var d decision
+	if err := json.Unmarshal(jsonOut.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Verdict != "BONK" || len(d.IPs) != 1 || d.IPs[0] != "203.0.113.7" {
+		t.Errorf("bad bonk decision %+v", d)
+	}
+}
+
+func TestJSONLogLines(t *testing.T) {
+	jsonOut := &bytes.Buffer{}
+	JSONLogger = log.New(jsonOut, "", 0)
+	oldNoColor := color.NoColor
+	color.NoColor = false
+	t.Cleanup(func() {
+		JSONLogger = log.New(io.Discard, "", 0)
+		color.NoColor = oldNoColor
+	})
+
+	logger := log.New(jsonLines{}, "", 0)
+	logger.Printf("[%s] %d %s saved to %s\n", color.CyanString("EVIDENCE"), 4242, "/usr/bin/gdb", "/var/bonk/evidence/1")
+
+	var line logLine
+	if err := json.Unmarshal(jsonOut.Bytes(), &line); err != nil {
+		t.Fatalf("%s: %q", err, jsonOut.String())
+	}
+	if line.Label != "EVIDENCE" || line.Message != "4242 /usr/bin/gdb saved to /var/bonk/evidence/1" {
+		t.Errorf("got %+v", line)
+	}
+}
@@ -1,56 +1,28 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
-	"log"
 	"os/user"
-	"regexp"
 	"strconv"
 	"strings"
-)
 
-var (
-	// auditIDRule = regexp.MustCompile("(:)(.*?)())")
-	msgRule = regexp.MustCompile(`audit\((.*?)\)`)
-	// syscall     = regexp.MustCompile("syscall=[0-9]{0,3}")
-
-	terminalRule  = regexp.MustCompile(`terminal=([\w\\/]+)`)
-	ttyRule       = regexp.MustCompile(`tty=([\w\\/]+)`)
-	exeRule       = regexp.MustCompile(`exe="(.*?)"`)
-	keyRule       = regexp.MustCompile(`key="(.*?)"`)
-	pidRule       = regexp.MustCompile(`pid=([\d]+)`)
-	ppidRule      = regexp.MustCompile(`ppid=([\d]+)`)
-	nameRule      = regexp.MustCompile(`name=\"(.*?)\"`)
-	auidRule      = regexp.MustCompile(`auid=([\d].?)+`)
-	uidRule       = regexp.MustCompile(`uid=([\d].?)+`)
-	auidRuleAlpha = regexp.MustCompile(`AUID="(.*?)"`)
-	proctileRule  = regexp.MustCompile(`proctitle=(([\w].?)+)`)
-	// Rules        = make(map[*regexp.Regexp]string)
+	"github.com/elastic/go-libaudit/v2/auparse"
 )
 
-// func init() {
-// 	Rules[terminalRule] = "terminal="
-// 	Rules[ttyRule] = "tty="
-// 	Rules[exeRule] = "exe="
-// 	Rules[keyRule] = "key="
-// 	Rules[pidRule] = "pid="
-// 	Rules[ppidRule] = "ppid="
-// 	Rules[nameRule] = "name="
-// 	Rules[auidRule] = "auid="
-// 	Rules[proctileRule] = "proctitle="
-// }
-
 type AuditMessageBonk struct {
 	// msg=audit(1364481363.243:24287):
 	AuditIDRaw string `json:"-"`
 	AuditID    string `json:"auditID"`
 	Timestamp  string `json:"timestamp"`
 
-	// syscall=2 (not used)
-	Syscall int `json:"Syscall"`
+	// syscall=59 (translated to its name by auparse, e.g. execve)
+	Syscall string `json:"syscall"`
+	// arch=c000003e (translated to its name by auparse, e.g. x86_64)
+	Arch string `json:"arch"`
 	// success=no
 	Success bool `json:"success"`
+	// exit=-13 (translated to its name by auparse, e.g. EACCES)
+	Exit string `json:"exit"`
 
 	// terminal=/dev/pts/0 (not found often ???)
 	Terminal string `json:"terminal"`
@@ -58,6 +30,8 @@ type AuditMessageBonk struct {
 	Tty string `json:"tty"`
 	// exe="/bin/cat"
 	Exe string `json:"exe"`
+	// comm="cat"
+	Comm string `json:"comm"`
 	// key="sshd_config"
 	Key string `json:"key"`
 
@@ -66,167 +40,195 @@ type AuditMessageBonk struct {
 	PPid              int    `json:"ppid"`
 	Auid              string `json:"auid"`
 	Uid               string `json:"uid"`
+	Euid              string `json:"euid"`
+	Gid               string `json:"gid"`
+	Ses               string `json:"ses"`
 	AuidHumanReadable string `json:"auid-hr"` //human readable
 
-	// name="/home/kevin"
-	Name string `json:"name"`
+	// from /proc/<pid>/cgroup, the id and runtime are empty on the host
+	Cgroup           string `json:"cgroup,omitempty"`
+	ContainerID      string `json:"container-id,omitempty"`
+	ContainerRuntime string `json:"container-runtime,omitempty"`
+	// namespace inodes by name (net, pid, mnt ...) from /proc/<pid>/ns
+	Namespaces map[string]string `json:"namespaces,omitempty"`
 
-	// proctile=636174002F6574632F7373682F737368645F636F6E666967
+	// who started whom, oldest first and ending with the process itself (sshd -> bash -> curl)
+	Ancestry []Ancestor `json:"ancestry,omitempty"`
+
+	// name="/home/kevin" (first PATH record)
+	Name string `json:"name"`
+	// every name= from the PATH records, in item order
+	Paths []string `json:"paths,omitempty"`
+	// cwd="/home/kevin"
+	Cwd string `json:"cwd"`
+
+	// a0="cat" a1="/etc/ssh/sshd_config" from the EXECVE records, or the decoded proctitle when there are none
+	Argv []string `json:"argv,omitempty"`
+	// the EXECVE records are gathered here until the whole event is in
+	execve *execveParts
+
+	// saddr=02000016C0A80001... decoded by auparse into family/addr/port
+	SockFamily string `json:"sock-family,omitempty"`
+	SockAddr   string `json:"sock-addr,omitempty"`
+	SockPort   string `json:"sock-port,omitempty"`
+
+	// proctile=636174002F6574632F7373682F737368645F636F6E666967 (space separated, cut at 128 bytes by the kernel)
 	Proctile              string `json:"proctitle"`
 	ProctileHumanreadable string `json:"-"`
+	// the proctitle split on its NULs
+	proctitleArgv []string
 
 	// Finished is the flag to say that it is done processing
 	// Extras
 	Finished bool `json:"-"`
 }
 
-func (a *AuditMessageBonk) InitAuditMessage(line string) error {
-	a.AuditIDRaw = ParseAuditRuleRegex(msgRule, line, "")
-
-	if a.AuditIDRaw != "" && len(a.AuditIDRaw) > 20 {
-		a.Timestamp = a.AuditIDRaw[6:20]
-		a.AuditID = a.AuditIDRaw[21:]
-		a.AuditID = strings.Trim(a.AuditID, ")")
-	} else {
-		return nil
+// NewAuditMessageBonk takes the records the reassembler grouped into one event and folds them into a single AuditMessageBonk
+func NewAuditMessageBonk(msgs []*auparse.AuditMessage) (AuditMessageBonk, error) {
+	var a AuditMessageBonk
+	if len(msgs) == 0 {
+		return a, fmt.Errorf("error> empty audit event")
 	}
-	// fmt.Printf("%s\t%s\n", a.Timestamp, a.AuditID)
 
-	// gross code. Take the regex from above along with the line and the key to remove
-	if out := ParseAuditRuleRegex(terminalRule, line, "terminal="); out != "" {
-		a.Tty = out
-	}
+	first := msgs[0]
+	a.Timestamp = fmt.Sprintf("%d.%03d", first.Timestamp.Unix(), first.Timestamp.Nanosecond()/1e6)
+	a.AuditID = strconv.FormatUint(uint64(first.Sequence), 10)
+	a.AuditIDRaw = fmt.Sprintf("audit(%s:%s)", a.Timestamp, a.AuditID)
 
-	if out := ParseAuditRuleRegex(ttyRule, line, "tty="); out != "" {
-		a.Tty = out
-	}
-	if out := ParseAuditRuleRegex(exeRule, line, "exe="); out != "" {
-		a.Exe = out
-	}
-	if out := ParseAuditRuleRegex(keyRule, line, "key="); out != "" {
-		a.Key = out
-	}
-	if out := ParseAuditRuleRegex(pidRule, line, "pid="); out != "" {
-		pid2int, err := strconv.Atoi(out)
-		if err != nil {
-			return fmt.Errorf("error>\n%s", err)
+	var errs []string
+	for _, msg := range msgs {
+		if err := a.InitAuditMessage(msg); err != nil {
+			errs = append(errs, err.Error())
 		}
-		a.Pid = pid2int
 	}
-	if out := ParseAuditRuleRegex(ppidRule, line, "ppid="); out != "" {
-		pid2int, err := strconv.Atoi(out)
-		if err != nil {
-			return fmt.Errorf("error>\n%v", err)
-		}
-
-		a.PPid = pid2int
-	}
-	// a.Name = ParseAuditRuleRegex(nameRule, line, "name=")
-	// a.Proctile = ParseAuditRuleRegex(proctileRule, line, "proctitle=")
-	// a.ProctileHumanreadable = string(a.Proctile)
-
-	if out := ParseAuditRuleRegex(nameRule, line, "name="); out != "" {
-		a.Name = out
+	if a.execve != nil {
+		a.Argv = a.execve.argv()
+		a.execve = nil
+	} else if len(a.proctitleArgv) > 0 {
+		a.Argv = a.proctitleArgv
 	}
+	a.Finished = true
 
-	if out := ParseAuditRuleRegex(proctileRule, line, "proctitle="); out != "" {
-		a.Proctile = out
-		// a := "2F7573722F73686172652F636F64652F636F6465202D2D756E6974792D6C61756E6368"
-		bs, err := hex.DecodeString(out)
-		if err != nil {
-			return fmt.Errorf("error>\n%v", err)
-		}
-		// out, err := strconv.Unquote("\"" + string(bs) + "\"")
-		// if err != nil {
-		// 	return fmt.Errorf("error>\n%v", err)
-		// }
-		a.Proctile = string(bs)
-
+	if len(errs) > 0 {
+		return a, fmt.Errorf("error> %s", strings.Join(errs, "; "))
 	}
+	return a, nil
+}
 
-	if out := ParseAuditRuleRegex(auidRule, line, "auid="); out != "" {
-		// a.Auid = ParseAuditRuleRegex(auidRule, line, "auid=")
-
-		// invalid username
-		if out != "4294967295" && out != "0" {
-			a.Auid = out
-			user, err := user.LookupId(out)
-			if err != nil {
-				return fmt.Errorf("error>\n%s", err)
-			}
-			a.AuidHumanReadable = user.Username
-		} else {
-			a.Auid = ""
-			a.AuidHumanReadable = ""
+// InitAuditMessage merges the fields of a single record into the event
+func (a *AuditMessageBonk) InitAuditMessage(msg *auparse.AuditMessage) error {
+	// auparse gives up on split arguments and on the records after the first, so EXECVE is read from the raw record
+	if msg.RecordType == auparse.AUDIT_EXECVE {
+		if a.execve == nil {
+			a.execve = &execveParts{args: make(map[int]string), chunks: make(map[int]map[int]string)}
 		}
+		return a.execve.add(msg.RawData)
 	}
 
-	if out := ParseAuditRuleRegex(uidRule, line, "uid="); out != "" {
-		// a.Auid = ParseAuditRuleRegex(auidRule, line, "auid=")
-		a.Uid = out
-
+	data, err := msg.Data()
+	if err != nil {
+		return fmt.Errorf("%s record: %w", msg.RecordType, err)
 	}
 
-	if out := ParseAuditRuleRegex(auidRuleAlpha, line, "AUID="); out != "" {
-		fmt.Println(out)
-		// TODO not found currently ??
-		a.AuidHumanReadable = out
+	// the rule key is pulled out of the fields by auparse
+	if tags, _ := msg.Tags(); len(tags) > 0 && a.Key == "" {
+		a.Key = tags[0]
 	}
 
-	return nil
+	switch msg.RecordType {
+	case auparse.AUDIT_SYSCALL:
+		a.Syscall = data["syscall"]
+		a.Arch = data["arch"]
+		a.Success = data["result"] == "success"
+		a.Exit = data["exit"]
+		a.Exe = data["exe"]
+		a.Comm = data["comm"]
+		a.Uid = data["uid"]
+		a.Euid = data["euid"]
+		a.Gid = data["gid"]
+		a.Ses = data["ses"]
 
-}
+		if tty := data["tty"]; tty != "" {
+			a.Tty = tty
+		}
+		if pid, err := strconv.Atoi(data["pid"]); err == nil {
+			a.Pid = pid
+		}
+		if ppid, err := strconv.Atoi(data["ppid"]); err == nil {
+			a.PPid = ppid
+		}
+		if err := a.setAuid(data["auid"]); err != nil {
+			return err
+		}
 
-func ParseAuditRuleRegex(rules *regexp.Regexp, msg string, remove string) string {
-	// apply regex magic. Maybe could be better
-	value := rules.Find([]byte(msg))
+	case auparse.AUDIT_PATH:
+		if name, found := data["name"]; found {
+			a.Paths = append(a.Paths, name)
+			if a.Name == "" {
+				a.Name = name
+			}
+		}
 
-	/*
-		The code below is necessary due to regex shenanigans. In order to use regex with lookaheads it violates golang's regex library promise to be o(n)
-		Subsequently we must comply and write the following code to remove the characters upto the equal
-		I could use regex+match second group but this works just fine!
-		https://groups.google.com/g/golang-nuts/c/7qgSDWPIh_E
-	*/
+	case auparse.AUDIT_CWD:
+		a.Cwd = data["cwd"]
 
-	// if it zero nothing found
-	if len(value) == 0 {
-		return ""
-	}
-	sizeOfRemove := len(remove)
+	case auparse.AUDIT_SOCKADDR:
+		a.SockFamily = data["family"]
+		a.SockAddr = data["addr"]
+		a.SockPort = data["port"]
+		if a.SockFamily == "unix" {
+			a.SockAddr = data["path"]
+		}
 
-	if sizeOfRemove > len(value) {
-		log.Fatalf("REMOVE=%s is too long for msg=%s\n", remove, msg)
-	}
-	// trim first n characters just to have what is longer than the value
-	output := string(value[sizeOfRemove:])
+	case auparse.AUDIT_PROCTITLE:
+		a.Proctile = data["proctitle"]
+		a.ProctileHumanreadable = a.Proctile
+		a.proctitleArgv = proctitleArgv(msg.RawData)
 
-	// remove quotes
-	if output[0] == '"' {
-		outputWithoutQuotes := strings.Trim(output, "\"")
-		return outputWithoutQuotes
+	default:
+		// user space messages (USER_CMD, USER_AUTH ...) carry the interesting bits without a SYSCALL record
+		if terminal := data["terminal"]; terminal != "" {
+			a.Terminal = terminal
+		}
+		if a.Exe == "" {
+			a.Exe = data["exe"]
+		}
+		if a.Pid == 0 {
+			if pid, err := strconv.Atoi(data["pid"]); err == nil {
+				a.Pid = pid
+			}
+		}
+		if a.Uid == "" {
+			a.Uid = data["uid"]
+		}
+		if a.Auid == "" && a.AuidHumanReadable == "" {
+			if err := a.setAuid(data["auid"]); err != nil {
+				return err
+			}
+		}
 	}
 
-	return output
-
+	return nil
 }
 
-func (a AuditMessageBonk) IsNewAuditID(line string) bool {
-	var AuditID string
-	AuditIDRaw := ParseAuditRuleRegex(msgRule, line, "")
-	if a.AuditIDRaw == "" {
-		return true
+// setAuid stores the login uid and resolves it to a username. auparse already turns 4294967295 into "unset"
+func (a *AuditMessageBonk) setAuid(auid string) error {
+	switch auid {
+	case "":
+		return nil
+	case "unset":
+		a.Auid = ""
+		a.AuidHumanReadable = "unset"
+		return nil
 	}
 
-	if AuditIDRaw != "" && len(AuditIDRaw) > 20 {
-		// Timestamp := a.AuditIDRaw[6:20]
-		AuditID = AuditIDRaw[21:]
-		AuditID = strings.Trim(AuditID, ")")
-		if AuditID == a.AuditID {
-			return false
-		} else {
-			return true
-		}
+	a.Auid = auid
+	u, err := user.LookupId(auid)
+	if err != nil {
+		// a deleted user, a container uid or a made up loginuid. Never leave it empty, an empty user is allowed
+		a.AuidHumanReadable = auid
+		return fmt.Errorf("error>\n%s", err)
 	}
-	return false
-
+	a.AuidHumanReadable = u.Username
+	return nil
 }
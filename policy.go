@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/fatih/color"
+)
+
+// what a policy does to a process that trips it
+const (
+	ActionKill   = "kill"   // SIGKILL, the classic bonk
+	ActionStop   = "stop"   // SIGSTOP, leaves the process around to look at
+	ActionFreeze = "freeze" // SIGSTOP (and optionally the cgroup freezer), tracked so it can be thawed or killed later
+	ActionLog    = "log"    // just write it down
+	ActionAlert  = "alert"  // write it down and always shout about it on stdout
+)
+
+// Policy decides what happens to a bonkable key. In config.json:
+//
+//	"policies": {
+//	    "software_mgmt": {"action": "kill", "allowed-user": ["root"], "allowed-exe": ["/usr/bin/apt"]},
+//	    "tracing": {"action": "kill", "allowed-user": []}
+//	}
+//
+// Leaving out allowed-user falls back to the global allowed-user list, an empty list allows nobody.
+// When both lists are given the user *and* the exe have to match
+type Policy struct {
+	Action    string   `json:"action"`
+	Users     []string `json:"allowed-user"`
+	Exes      []string `json:"allowed-exe"`
+	Threshold int      `json:"threshold"`       // hits per user before acting, 0 or 1 acts right away
+	Scope     string   `json:"scope,omitempty"` // process (default), tree, pgroup, session or login
+	// only act when the process runs under one of these exes (a web server worker, say)
+	Ancestors []string `json:"ancestor,omitempty"`
+	// never act when the process runs under one of these exes (an admin's sshd login, say)
+	AllowedAncestors []string `json:"allowed-ancestor,omitempty"`
+	// only act when the command line matches one of these regular expressions
+	Cmdline []string `json:"cmdline,omitempty"`
+	// never act when the command line matches one of these regular expressions
+	AllowedCmdline []string `json:"allowed-cmdline,omitempty"`
+	// used instead of this one for events from inside a container
+	Container *Policy `json:"container,omitempty"`
+	// with the freeze action also freeze the process's whole cgroup through cgroup.freeze
+	FreezeCgroup bool `json:"freeze-cgroup,omitempty"`
+
+	// set for keys that only show up in the flat bonkable list (or policies without allowed-user)
+	inheritUsers bool
+}
+
+// stopPid is SIGSTOP's version of killPid
+var stopPid = func(pid int) error {
+	return syscall.Kill(pid, syscall.SIGSTOP)
+}
+
+// policyHits counts the hits per key and user for policies with a threshold. Only touched from bonkProc
+var policyHits = make(map[string]int)
+
+func validAction(action string) bool {
+	switch action {
+	case ActionKill, ActionStop, ActionFreeze, ActionLog, ActionAlert:
+		return true
+	}
+	return false
+}
+
+// Allows says whether this event gets a pass: it is not what the policy is after, or it is one of the allowed ones
+func (p Policy) Allows(a AuditMessageBonk) bool {
+	return !p.triggeredBy(a) || p.allowsProcess(a)
+}
+
+// triggeredBy says whether the event is what the policy is after (under one of its ancestors, matching one of its command lines).
+// Only the reported event is asked, the other pids of a scope go down with it whatever they run
+func (p Policy) triggeredBy(a AuditMessageBonk) bool {
+	if len(p.Ancestors) > 0 && !underAncestor(a, p.Ancestors) {
+		return false
+	}
+	if len(p.Cmdline) > 0 && !matchCmdline(a, p.Cmdline) {
+		return false
+	}
+	return true
+}
+
+// allowsProcess says whether the process is one of the allowed user/exe combinations, or runs under an allowed ancestor or command line
+func (p Policy) allowsProcess(a AuditMessageBonk) bool {
+	if underAncestor(a, p.AllowedAncestors) {
+		return true
+	}
+	if matchCmdline(a, p.AllowedCmdline) {
+		return true
+	}
+
+	userOK := false
+	if p.inheritUsers {
+		userOK = cf.AllowedUser(a.AuidHumanReadable)
+	} else {
+		for _, user := range p.Users {
+			if a.AuidHumanReadable == user {
+				userOK = true
+				break
+			}
+		}
+	}
+
+	exeOK := len(p.Exes) == 0
+	for _, exe := range p.Exes {
+		if a.Exe == exe {
+			exeOK = true
+			break
+		}
+	}
+
+	return userOK && exeOK
+}
+
+// hit counts another offense and says whether the threshold has been reached
+func (p Policy) hit(key string, user string) (int, bool) {
+	if p.Threshold <= 1 {
+		return 1, true
+	}
+	id := key + "/" + user
+	policyHits[id]++
+	return policyHits[id], policyHits[id] >= p.Threshold
+}
+
+// actReport is what act did: the scope it ended up using, the pids it was actually done to and the ones it left alone (and why)
+type actReport struct {
+	scope   string
+	done    []int
+	skipped []string
+}
+
+// act does the policy's action to every process in its scope. log and alert leave everything alone
+func (p Policy) act(a AuditMessageBonk) (actReport, error) {
+	var report actReport
+	if !p.touchesProcess() {
+		return report, nil
+	}
+
+	targets, skipped, scope := scopeTargets(p, a)
+	report.scope, report.skipped = scope, skipped
+
+	if p.Action == ActionFreeze {
+		var err error
+		report.done, err = freeze(a, targets, p.FreezeCgroup)
+		return report, err
+	}
+
+	// freeze the lot first so nothing in the scope can fork a replacement in between kills
+	if p.Action == ActionKill && len(targets) > 1 {
+		for _, pid := range targets {
+			stopPid(pid)
+		}
+	}
+
+	var errs []string
+	for _, pid := range targets {
+		var err error
+		if p.Action == ActionKill {
+			err = killPid(pid)
+		} else {
+			err = stopPid(pid)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%d: %s", pid, err))
+			continue
+		}
+		report.done = append(report.done, pid)
+	}
+
+	if len(errs) > 0 {
+		return report, errors.New(strings.Join(errs, "; "))
+	}
+	return report, nil
+}
+
+// forEvent picks the policy that applies to the event: the container one for events from inside a container, when there is one
+func (p Policy) forEvent(a AuditMessageBonk) Policy {
+	if !a.InContainer() || p.Container == nil {
+		return p
+	}
+	container := *p.Container
+	if container.Action == "" {
+		container.Action = ActionKill
+	}
+	container.inheritUsers = container.Users == nil
+	return container
+}
+
+// touchesProcess says whether the action does something to the process rather than just write it down
+func (p Policy) touchesProcess() bool {
+	return p.Action == ActionKill || p.Action == ActionStop || p.Action == ActionFreeze
+}
+
+// label is what the log line gets tagged with
+func (p Policy) label() (string, func(format string, a ...interface{}) string) {
+	switch p.Action {
+	case ActionStop:
+		return "STOP", color.RedString
+	case ActionFreeze:
+		return "FREEZE", color.HiCyanString
+	case ActionLog:
+		return "LOG", color.CyanString
+	case ActionAlert:
+		return "ALERT", color.HiYellowString
+	}
+	return "BONK", color.RedString
+}
+
+// formatEvent builds the usual one line summary of an event
+func formatEvent(label string, paint func(format string, a ...interface{}) string, a AuditMessageBonk) string {
+	line := fmt.Sprintf("[%s] USER:%s\t;KEY %s\t; CMD: %s;\tCMD_F: %s;\t", paint(label),
+		paint(a.AuidHumanReadable), paint(a.Key),
+		paint(a.Exe), paint(a.CommandLine()),
+	)
+	if a.InContainer() {
+		line += fmt.Sprintf("CONTAINER: %s/%s;", a.ContainerRuntime, shortID(a.ContainerID))
+	}
+	if len(a.Ancestry) > 1 {
+		line += fmt.Sprintf("TREE: %s;", ancestryString(a.Ancestry))
+	}
+	return line
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var policyConfig = `{
+	"allowed-user": ["root", "unset"],
+	"bonkable": ["sshd"],
+	"policies": {
+		"software_mgmt": {"allowed-user": ["root"], "allowed-exe": ["/usr/bin/apt"]},
+		"tracing": {"action": "kill", "allowed-user": []},
+		"power": {"action": "stop", "allowed-user": []},
+		"mail": {"action": "log", "allowed-user": []},
+		"cron": {"threshold": 3, "allowed-user": []}
+	}
+}`
+
+func loadPolicyConfig(t *testing.T) Config {
+	t.Helper()
+	var config Config
+	if err := json.Unmarshal([]byte(policyConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  AuditMessageBonk
+		killed bool
+		label  string
+	}{
+		{"allowed user and exe", AuditMessageBonk{Key: "software_mgmt", AuidHumanReadable: "root", Exe: "/usr/bin/apt"}, false, "[COOL]"},
+		{"allowed user wrong exe", AuditMessageBonk{Key: "software_mgmt", AuidHumanReadable: "root", Exe: "/tmp/apt"}, true, "[BONK]"},
+		{"wrong user allowed exe", AuditMessageBonk{Key: "software_mgmt", AuidHumanReadable: "bob", Exe: "/usr/bin/apt"}, true, "[BONK]"},
+		{"nobody allowed", AuditMessageBonk{Key: "tracing", AuidHumanReadable: "root", Exe: "/usr/bin/gdb"}, true, "[BONK]"},
+		{"flat list uses global users", AuditMessageBonk{Key: "sshd", AuidHumanReadable: "root"}, false, "[COOL]"},
+		{"flat list bonks the rest", AuditMessageBonk{Key: "sshd", AuidHumanReadable: "bob"}, true, "[BONK]"},
+		{"log only", AuditMessageBonk{Key: "mail", AuidHumanReadable: "bob"}, false, "[LOG]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			killed, out := setupReceive(t, "bonk", loadPolicyConfig(t))
+			tt.event.Pid = testPid
+
+			msg, _ := bonkProc(tt.event, "")
+
+			if got := len(*killed) == 1; got != tt.killed {
+				t.Errorf("killed=%v, want %v", got, tt.killed)
+			}
+			if !strings.Contains(msg, tt.label) || !strings.Contains(out.String(), tt.label) {
+				t.Errorf("got %q, want %s", msg, tt.label)
+			}
+		})
+	}
+}
+
+func TestPolicyStop(t *testing.T) {
+	killed, _ := setupReceive(t, "bonk", loadPolicyConfig(t))
+	var stopped []int
+	oldStop := stopPid
+	stopPid = func(pid int) error {
+		stopped = append(stopped, pid)
+		return nil
+	}
+	t.Cleanup(func() { stopPid = oldStop })
+
+	msg, _ := bonkProc(AuditMessageBonk{Key: "power", AuidHumanReadable: "root", Pid: testPid}, "")
+
+	if len(stopped) != 1 || len(*killed) != 0 {
+		t.Errorf("stopped=%v killed=%v, want one stop", stopped, *killed)
+	}
+	if !strings.Contains(msg, "[STOP]") {
+		t.Errorf("got %q, want [STOP]", msg)
+	}
+}
+
+func TestPolicyThreshold(t *testing.T) {
+	killed, _ := setupReceive(t, "bonk", loadPolicyConfig(t))
+	policyHits = make(map[string]int)
+
+	event := AuditMessageBonk{Key: "cron", AuidHumanReadable: "bob", Pid: testPid}
+	for i, want := range []string{"[STRIKE 1/3]", "[STRIKE 2/3]", "[BONK]"} {
+		msg, _ := bonkProc(event, "")
+		if !strings.Contains(msg, want) {
+			t.Errorf("hit %d got %q, want %s", i+1, msg, want)
+		}
+	}
+	if len(*killed) != 1 {
+		t.Errorf("killed %v, want one kill on the third hit", *killed)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the tree is refreshed from /proc
+	PROCTREESCANINTERVAL = time.Minute
+	// processes that exited are kept this long, their children's events can still be in flight
+	PROCTREEKEEP = 10 * time.Minute
+	// deepest ancestry chain followed, a loop in stale data must not hang bonk
+	PROCTREEMAXDEPTH = 64
+)
+
+// Ancestor is one process in an event's ancestry chain
+type Ancestor struct {
+	Pid  int    `json:"pid"`
+	Exe  string `json:"exe"`
+	Comm string `json:"comm"`
+}
+
+type procNode struct {
+	ppid int
+	exe  string
+	comm string
+	seen time.Time
+}
+
+// procTree is bonk's picture of who started whom, fed by every audit event (and the clone/fork ones especially)
+// and refreshed from /proc
+var procTree = struct {
+	sync.Mutex
+	nodes map[int]procNode
+}{nodes: make(map[int]procNode)}
+
+// forkSyscalls return the child's pid in exit
+var forkSyscalls = map[string]bool{"clone": true, "clone3": true, "fork": true, "vfork": true}
+
+// trackProcess() feeds an event into the tree
+func trackProcess(a AuditMessageBonk) {
+	if a.Pid <= 0 {
+		return
+	}
+	now := time.Now()
+
+	procTree.Lock()
+	defer procTree.Unlock()
+
+	procTree.nodes[a.Pid] = procNode{ppid: a.PPid, exe: a.Exe, comm: a.Comm, seen: now}
+
+	// the child of a fork starts out as a copy of its parent
+	if forkSyscalls[a.Syscall] && a.Success {
+		if child, err := strconv.Atoi(a.Exit); err == nil && child > 0 {
+			procTree.nodes[child] = procNode{ppid: a.Pid, exe: a.Exe, comm: a.Comm, seen: now}
+		}
+	}
+}
+
+// readProcNode() reads one process straight from /proc
+func readProcNode(pid int) (procNode, error) {
+	ppid, err := parentPid(pid)
+	if err != nil {
+		return procNode{}, err
+	}
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	comm, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	return procNode{ppid: ppid, exe: exe, comm: strings.TrimSpace(string(comm)), seen: time.Now()}, nil
+}
+
+// scanProcTree() refreshes the tree from /proc and forgets processes that have been gone for a while
+func scanProcTree() {
+	live := make(map[int]procNode)
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if node, err := readProcNode(pid); err == nil {
+			live[pid] = node
+		}
+	}
+
+	procTree.Lock()
+	defer procTree.Unlock()
+	for pid, node := range procTree.nodes {
+		if _, alive := live[pid]; !alive && time.Since(node.seen) > PROCTREEKEEP {
+			delete(procTree.nodes, pid)
+		}
+	}
+	for pid, node := range live {
+		procTree.nodes[pid] = node
+	}
+}
+
+// startProcTree() fills the tree and keeps it fresh
+func startProcTree() {
+	scanProcTree()
+	go func() {
+		for range time.Tick(PROCTREESCANINTERVAL) {
+			scanProcTree()
+		}
+	}()
+}
+
+// lookupProc() finds a process in the tree, falling back to /proc (except in replay, where the pids are history)
+func lookupProc(pid int) (procNode, bool) {
+	procTree.Lock()
+	node, ok := procTree.nodes[pid]
+	procTree.Unlock()
+	if ok || *mode == "replay" {
+		return node, ok
+	}
+
+	node, err := readProcNode(pid)
+	if err != nil {
+		return node, false
+	}
+	procTree.Lock()
+	procTree.nodes[pid] = node
+	procTree.Unlock()
+	return node, true
+}
+
+// ancestryOf() is the chain from the oldest known ancestor down to the process itself
+func ancestryOf(pid int, ppid int, exe string, comm string) []Ancestor {
+	chain := []Ancestor{{Pid: pid, Exe: exe, Comm: comm}}
+	seen := map[int]bool{pid: true}
+	for cur := ppid; cur > 0 && !seen[cur] && len(chain) < PROCTREEMAXDEPTH; {
+		seen[cur] = true
+		node, ok := lookupProc(cur)
+		if !ok {
+			chain = append(chain, Ancestor{Pid: cur})
+			break
+		}
+		chain = append(chain, Ancestor{Pid: cur, Exe: node.exe, Comm: node.comm})
+		cur = node.ppid
+	}
+
+	// oldest first, the way people say it: sshd -> bash -> curl
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// ancestryString() turns the chain into "sshd -> bash -> curl"
+func ancestryString(chain []Ancestor) string {
+	names := make([]string, len(chain))
+	for i, p := range chain {
+		switch {
+		case p.Comm != "":
+			names[i] = p.Comm
+		case p.Exe != "":
+			names[i] = p.Exe
+		default:
+			names[i] = strconv.Itoa(p.Pid)
+		}
+	}
+	return strings.Join(names, " -> ")
+}
+
+// underAncestor() says whether any ancestor (not the process itself) runs one of the exes
+func underAncestor(a AuditMessageBonk, exes []string) bool {
+	if len(a.Ancestry) < 2 {
+		return false
+	}
+	for _, p := range a.Ancestry[:len(a.Ancestry)-1] {
+		for _, exe := range exes {
+			if p.Exe == exe {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func execRecord(seq, pid, ppid int, exe, key string) string {
+	comm := exe[strings.LastIndex(exe, "/")+1:]
+	return fmt.Sprintf(`type=SYSCALL msg=audit(1364481363.243:%d): arch=c000003e syscall=59 success=yes exit=0 a0=10 a1=1 a2=0 a3=0 items=0 ppid=%d pid=%d auid=4294967295 uid=0 gid=0 euid=0 suid=0 fsuid=0 egid=0 sgid=0 fsgid=0 tty=pts0 ses=1 comm="%s" exe="%s" key="%s"`, seq, ppid, pid, comm, exe, key)
+}
+
+func TestAncestryFromEvents(t *testing.T) {
+	setupReceive(t, "replay", testConfig)
+
+	trackProcess(AuditMessageBonk{Pid: 91000100, PPid: 1, Exe: "/usr/sbin/sshd", Comm: "sshd"})
+	trackProcess(AuditMessageBonk{Pid: 91000200, PPid: 91000100, Exe: "/bin/bash", Comm: "bash"})
+	// bash forks, the child shows up before it ever execs
+	trackProcess(AuditMessageBonk{Pid: 91000200, PPid: 91000100, Exe: "/bin/bash", Comm: "bash", Syscall: "clone", Success: true, Exit: "91000300"})
+
+	chain := ancestryOf(91000300, 91000200, "/usr/bin/curl", "curl")
+	if got := ancestryString(chain); !strings.HasSuffix(got, "sshd -> bash -> curl") {
+		t.Errorf("got %q", got)
+	}
+	if !underAncestor(AuditMessageBonk{Ancestry: chain}, []string{"/usr/sbin/sshd"}) {
+		t.Error("sshd is not an ancestor")
+	}
+	if underAncestor(AuditMessageBonk{Ancestry: chain}, []string{"/usr/bin/curl"}) {
+		t.Error("the process counts as its own ancestor")
+	}
+}
+
+func TestAncestorPolicies(t *testing.T) {
+	config := testConfig
+	config.Policies = map[string]Policy{
+		"sbin_susp": {Action: ActionKill, Users: []string{}, Ancestors: []string{"/usr/sbin/nginx"}, AllowedAncestors: []string{"/usr/sbin/sshd"}},
+	}
+	killed, out := setupReceive(t, "bonk", config)
+
+	src := newMemorySource(t,
+		// nginx -> worker -> sh
+		execRecord(1, 92000100, 1, "/usr/sbin/nginx", "none"),
+		execRecord(2, 92000101, 92000100, "/usr/sbin/nginx", "none"),
+		execRecord(3, 92000102, 92000101, "/bin/sh", "sbin_susp"),
+		// sshd -> bash -> sh
+		execRecord(4, 92000200, 1, "/usr/sbin/sshd", "none"),
+		execRecord(5, 92000201, 92000200, "/bin/bash", "none"),
+		execRecord(6, 92000202, 92000201, "/bin/sh", "sbin_susp"),
+		// neither
+		execRecord(7, 92000300, 1, "/usr/bin/cron", "none"),
+		execRecord(8, 92000301, 92000300, "/bin/sh", "sbin_susp"),
+	)
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 1 || (*killed)[0] != 92000102 {
+		t.Errorf("killed %v, want only the shell under nginx", *killed)
+	}
+	if !strings.Contains(out.String(), "TREE: ") || !strings.Contains(out.String(), "nginx -> nginx -> sh;") {
+		t.Errorf("missing ancestry in %q", out.String())
+	}
+}
+
+func TestLoadRejectsRelativeAncestor(t *testing.T) {
+	if err := loadTestConfig(t, `{"policies": {"sbin_susp": {"ancestor": ["nginx"]}}}`); err == nil {
+		t.Error("comm name accepted as an ancestor")
+	}
+}
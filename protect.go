@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// PF_KTHREAD from include/linux/sched.h, set in /proc/<pid>/stat flags for kernel threads
+const PF_KTHREAD = 0x00200000
+
+// bonkAncestors are bonk's own parents (the shell, sudo, sshd, systemd ...), worked out once
+var bonkAncestors = struct {
+	sync.Once
+	pids map[int]bool
+}{}
+
+func isBonkAncestor(pid int) bool {
+	bonkAncestors.Do(func() {
+		bonkAncestors.pids = make(map[int]bool)
+		for p := os.Getppid(); p > 1 && !bonkAncestors.pids[p]; {
+			bonkAncestors.pids[p] = true
+			next, err := parentPid(p)
+			if err != nil {
+				break
+			}
+			p = next
+		}
+	})
+	return bonkAncestors.pids[pid]
+}
+
+// isKernelThread() checks the PF_KTHREAD flag (stat field 9). kthreadd (pid 2) and its children are all kernel threads
+func isKernelThread(pid int) bool {
+	if pid == 2 {
+		return true
+	}
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	end := strings.LastIndexByte(string(data), ')')
+	if end == -1 {
+		return false
+	}
+	// state ppid pgrp session tty_nr tpgid flags
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 7 {
+		return false
+	}
+	if fields[1] == "2" {
+		return true
+	}
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	return err == nil && flags&PF_KTHREAD != 0
+}
+
+// isProtected() says whether a process must never be killed or stopped, and why. Getting allowed-user wrong
+// should cost an alert, not init, sshd or bonk itself
+func isProtected(a AuditMessageBonk) (bool, string) {
+	// kill(0) and kill(-1) hit whole groups, never send those
+	if a.Pid <= 0 {
+		return true, "no pid"
+	}
+	if a.Pid == 1 {
+		return true, "PID 1 (init)"
+	}
+	if cf.ProtectedExe(a.Exe) {
+		return true, fmt.Sprintf("protected exe %s", a.Exe)
+	}
+
+	// the pids in a replayed log belong to someone else now
+	if *mode == "replay" {
+		return false, ""
+	}
+	if a.Pid == os.Getpid() {
+		return true, "bonk itself"
+	}
+	if isBonkAncestor(a.Pid) {
+		return true, "parent of bonk"
+	}
+	if isKernelThread(a.Pid) {
+		return true, "kernel thread"
+	}
+	return false, ""
+}
+
+// protectedError is what bonkIP returns instead of killing a protected process
+type protectedError struct {
+	why string
+}
+
+func (e protectedError) Error() string {
+	return "protected: " + e.why
+}
+
+// protectedEvent() is the alert line for an action that was not taken
+func protectedEvent(a AuditMessageBonk, action string, why string) string {
+	return formatEvent("PROTECTED", color.HiRedString, a) + fmt.Sprintf(" %s not done, %s;", action, why)
+}
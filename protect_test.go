@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIsProtected(t *testing.T) {
+	setupReceive(t, "bonk", Config{ProtectedExes: []string{"/usr/sbin/sshd"}})
+
+	for _, a := range []AuditMessageBonk{
+		{Pid: 0},
+		{Pid: 1},
+		{Pid: os.Getpid()},
+		{Pid: os.Getppid()},
+		{Pid: testPid, Exe: "/usr/sbin/sshd"},
+	} {
+		if protected, _ := isProtected(a); !protected {
+			t.Errorf("%d %s is not protected", a.Pid, a.Exe)
+		}
+	}
+
+	if protected, why := isProtected(AuditMessageBonk{Pid: testPid, Exe: "/usr/bin/gdb"}); protected {
+		t.Errorf("gdb is protected: %s", why)
+	}
+}
+
+func TestReceiveDowngradesProtectedToAlert(t *testing.T) {
+	config := testConfig
+	config.ProtectedExes = []string{"/usr/bin/gdb"}
+	killed, out := setupReceive(t, "bonk", config)
+	src := newMemorySource(t,
+		syscallRecord(100, testPid, "4294967295", "tracing"),
+		eoeRecord(100),
+	)
+
+	if err := receive(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 0 {
+		t.Errorf("killed %v, want nothing", *killed)
+	}
+	if !strings.Contains(out.String(), "[PROTECTED]") || !strings.Contains(out.String(), "kill not done, protected exe /usr/bin/gdb") {
+		t.Errorf("missing protected log line, got %q", out.String())
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/fatih/color"
+)
+
+// cfMu is held while an event is judged and while cf is swapped, so no event ever sees half of each config
+var cfMu sync.Mutex
+
+// reloadConfig() loads the config file into a fresh Config and only swaps it in when it is valid
+func reloadConfig(path string) error {
+	var next Config
+	if err := next.Load(path); err != nil {
+		return fmt.Errorf("%s not reloaded, keeping the old config: %w", path, err)
+	}
+	warnings, errs := next.Check()
+	if len(errs) > 0 && *mode == "bonk" {
+		return fmt.Errorf("%s not reloaded, keeping the old config: %s", path, strings.Join(errs, "; "))
+	}
+	warnings = append(warnings, errs...)
+
+	cfMu.Lock()
+	prev := cf
+	cf = next
+	cfMu.Unlock()
+
+	changes := configDiff(prev, next)
+	if len(changes) == 0 {
+		changes = []string{"no changes"}
+	}
+	for _, change := range changes {
+		outMessage := fmt.Sprintf("[%s] %s", color.CyanString("RELOAD"), change)
+		CoolLogger.Println(outMessage)
+		if *verbose {
+			fmt.Println(outMessage)
+		}
+	}
+	for _, warning := range warnings {
+		outMessage := fmt.Sprintf("[%s] %s", color.HiYellowString("WARN"), warning)
+		CoolLogger.Println(outMessage)
+		if *verbose {
+			fmt.Println(outMessage)
+		}
+	}
+	return nil
+}
+
+// listDiff() lists what was added to and removed from a list setting
+func listDiff(name string, prev []string, next []string) []string {
+	var changes []string
+	inPrev, inNext := make(map[string]bool), make(map[string]bool)
+	for _, v := range prev {
+		inPrev[v] = true
+	}
+	for _, v := range next {
+		inNext[v] = true
+	}
+	for _, v := range next {
+		if !inPrev[v] {
+			changes = append(changes, fmt.Sprintf("%s + %q", name, v))
+			inPrev[v] = true
+		}
+	}
+	for _, v := range prev {
+		if !inNext[v] {
+			changes = append(changes, fmt.Sprintf("%s - %q", name, v))
+			inNext[v] = true
+		}
+	}
+	return changes
+}
+
+// configDiff() describes what changed between two configs, one line per change
+func configDiff(prev Config, next Config) []string {
+	var changes []string
+	changes = append(changes, listDiff("allowed-user", prev.Users, next.Users)...)
+	changes = append(changes, listDiff("bonkable", prev.Bonkable, next.Bonkable)...)
+	changes = append(changes, listDiff("banned-ips", prev.BadIPs, next.BadIPs)...)
+	changes = append(changes, listDiff("allowed-ips", prev.GoodIPs, next.GoodIPs)...)
+	changes = append(changes, listDiff("blocklists", prev.Blocklists, next.Blocklists)...)
+
+	keys := make(map[string]bool)
+	for key := range prev.Policies {
+		keys[key] = true
+	}
+	for key := range next.Policies {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		before, hadBefore := prev.Policies[key]
+		after, hasAfter := next.Policies[key]
+		switch {
+		case !hadBefore:
+			changes = append(changes, fmt.Sprintf("policies + %q %s", key, policyJSON(after)))
+		case !hasAfter:
+			changes = append(changes, fmt.Sprintf("policies - %q %s", key, policyJSON(before)))
+		case !reflect.DeepEqual(before, after):
+			changes = append(changes, fmt.Sprintf("policies ~ %q %s -> %s", key, policyJSON(before), policyJSON(after)))
+		}
+	}
+
+	var prevExes, nextExes []string
+	for _, t := range prev.TrustedExes {
+		prevExes = append(prevExes, t.Path+"@"+t.SHA256)
+	}
+	for _, t := range next.TrustedExes {
+		nextExes = append(nextExes, t.Path+"@"+t.SHA256)
+	}
+	changes = append(changes, listDiff("trusted-exes", prevExes, nextExes)...)
+	changes = append(changes, listDiff("protected-exes", prev.ProtectedExes, next.ProtectedExes)...)
+
+	// the kernel only sees rules through load/sync, say so instead of pretending they took effect
+	if !reflect.DeepEqual(prev.Rules, next.Rules) || prev.RulesDir != next.RulesDir {
+		changes = append(changes, "rules changed, run -mode=sync to apply them")
+	}
+	return changes
+}
+
+func policyJSON(p Policy) string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+// watchConfig() reloads the config on SIGHUP and, with -watch, whenever the file is written or replaced
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	changed := make(chan struct{}, 1)
+	if *watch {
+		if err := inotifyConfig(path, changed); err != nil {
+			fmt.Printf("error> -watch: %s\n", err)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-changed:
+			}
+			if err := reloadConfig(path); err != nil {
+				CoolLogger.Printf("[%s] %s\n", color.RedString("RELOAD"), err)
+				fmt.Printf("error> %s\n", err)
+			}
+		}
+	}()
+}
+
+// inotifyConfig() watches the directory rather than the file, editors and config management replace the file by renaming over it
+func inotifyConfig(path string, changed chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil || n <= 0 {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				if strings.TrimRight(string(nameBytes), "\x00") == name {
+					// a burst of writes only needs one reload
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadConfigSwapsValidConfig(t *testing.T) {
+	_, out := setupReceive(t, "bonk", testConfig)
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"allowed-user": ["root", "daemon"], "bonkable": ["tracing", "sshd"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsBonkable("sshd") {
+		t.Error("new config was not swapped in")
+	}
+	for _, want := range []string{`allowed-user + "daemon"`, `bonkable + "sshd"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in %q", want, out.String())
+		}
+	}
+
+	// a broken file leaves the running config alone
+	if err := ioutil.WriteFile(path, []byte(`{"banned-ips": ["10.0.0"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path); err == nil {
+		t.Error("invalid config was accepted")
+	}
+	if !cf.IsBonkable("sshd") {
+		t.Error("invalid config replaced the running one")
+	}
+
+	// so does one whose allowed-user would never match
+	if err := ioutil.WriteFile(path, []byte(`{"allowed-user": ["rooot"], "bonkable": ["tracing"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path); err == nil || !strings.Contains(err.Error(), `user "rooot" does not exist`) {
+		t.Errorf("got %v, want the unknown user refused", err)
+	}
+	if !cf.AllowedUser("daemon") {
+		t.Error("config with an unknown user replaced the running one")
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	prev := Config{
+		Users:    []string{"root"},
+		Policies: map[string]Policy{"tracing": {Action: ActionKill}, "cron": {Action: ActionAlert}},
+		Rules:    []string{"-w /etc/passwd -p wa -k passwd"},
+	}
+	next := Config{
+		Users:    []string{"root"},
+		Policies: map[string]Policy{"tracing": {Action: ActionStop}, "power": {Action: ActionLog}},
+	}
+
+	want := []string{
+		`policies - "cron" {"action":"alert","allowed-user":null,"allowed-exe":null,"threshold":0}`,
+		`policies + "power" {"action":"log","allowed-user":null,"allowed-exe":null,"threshold":0}`,
+		`policies ~ "tracing" {"action":"kill","allowed-user":null,"allowed-exe":null,"threshold":0} -> {"action":"stop","allowed-user":null,"allowed-exe":null,"threshold":0}`,
+		"rules changed, run -mode=sync to apply them",
+	}
+	if got := configDiff(prev, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestConfigDiffProtectedExes(t *testing.T) {
+	prev := Config{ProtectedExes: []string{"/usr/sbin/sshd", "/usr/lib/systemd/systemd"}}
+	next := Config{ProtectedExes: []string{"/usr/lib/systemd/systemd", "/usr/sbin/cron"}}
+
+	want := []string{`protected-exes + "/usr/sbin/cron"`, `protected-exes - "/usr/sbin/sshd"`}
+	if got := configDiff(prev, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInotifyConfigSeesReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	changed := make(chan struct{}, 1)
+	if err := inotifyConfig(path, changed); err != nil {
+		t.Skip(err)
+	}
+
+	// other files in the directory do not count
+	ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644)
+	ioutil.WriteFile(path, []byte("{}"), 0644)
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Error("no change seen")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
+)
+
+// diagRecord() builds one netlink message the way -diag dumps it: header in host (little endian) order, payload, NUL padding
+func diagRecord(typ auparse.AuditMessageType, payload string, length uint32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, length)
+	binary.Write(&b, binary.LittleEndian, uint16(typ))
+	binary.Write(&b, binary.LittleEndian, uint16(0))    // flags
+	binary.Write(&b, binary.LittleEndian, uint32(1))    // seq
+	binary.Write(&b, binary.LittleEndian, uint32(4242)) // pid
+	b.WriteString(payload)
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// body() is a record without its "type=... msg=" part, which is what netlink carries
+func body(line string) string {
+	return line[strings.Index(line, "msg=")+len("msg="):]
+}
+
+func TestReplay(t *testing.T) {
+	diag := append(diagRecord(auparse.AUDIT_SYSCALL, body(syscallRecord(100, testPid, "4294967295", "tracing")), 16+200),
+		// the kernel leaves nlmsg_len at 0 sometimes, the payload is still found
+		diagRecord(auparse.AUDIT_PROCTITLE, body(proctitleRecord(100, "gdb -p 1")), 0)...)
+	diag = append(diag, diagRecord(auparse.AUDIT_SYSCALL, body(syscallRecord(101, testOtherPid, "4294967295", "sysctl")), 16)...)
+	diag = append(diag, diagRecord(auparse.AUDIT_EOE, body(eoeRecord(100)), 16)...)
+	diag = append(diag, diagRecord(auparse.AUDIT_EOE, body(eoeRecord(101)), 16)...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{
+			name: "bonk-verbose.log",
+			data: []byte(strings.Join([]string{
+				"bonk.go:451: " + syscallRecord(100, testPid, "4294967295", "tracing"),
+				"bonk.go:451: " + proctitleRecord(100, "gdb -p 1"),
+				"bonk.go:451: " + eoeRecord(100),
+			}, "\n") + "\n"),
+			want: []string{"[BONK] USER:unset", "gdb -p 1"},
+		},
+		{
+			name: "audit.log with node= and enriched fields",
+			data: []byte(strings.Join([]string{
+				"node=web1 " + syscallRecord(100, testPid, "0", "tracing") + "\x1dARCH=x86_64 SYSCALL=ptrace AUID=\"root\" UID=\"root\"",
+				// the hex proctitle runs straight into the separator, it only decodes once that is cut off
+				"node=web1 " + proctitleRecord(100, "gdb -p 1") + "\x1dPROCTITLE=\"gdb -p 1\"",
+				"node=web1 " + syscallRecord(101, testOtherPid, "4294967295", "sysctl") + "\x1dAUID=\"unset\"",
+				"node=web1 " + eoeRecord(100),
+				"node=web1 " + eoeRecord(101),
+			}, "\n") + "\n"),
+			want: []string{"[COOL] USER:root\t;KEY tracing\t; CMD: /usr/bin/gdb;\tCMD_F: gdb -p 1;", "[INFO] USER:unset\t;KEY sysctl"},
+		},
+		{
+			name: "-diag netlink dump",
+			data: diag,
+			want: []string{"[BONK] USER:unset", "gdb -p 1", "[INFO] USER:unset\t;KEY sysctl"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			killed, out := setupReceive(t, "replay", testConfig)
+			path := filepath.Join(t.TempDir(), "replay.log")
+			if err := ioutil.WriteFile(path, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := replay(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(*killed) != 0 {
+				t.Errorf("replay killed %v", *killed)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("missing %q in:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
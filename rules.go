@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ruleLine is a single audit rule plus where it was read from
+type ruleLine struct {
+	Rule   string
+	Source string
+	Line   int
+}
+
+func (r ruleLine) String() string {
+	return fmt.Sprintf("%s:%d", r.Source, r.Line)
+}
+
+// control lines set up auditd itself (-D delete all, -b backlog, -e enabled ...). bonk handles those with its own flags
+var controlPrefixes = []string{"-D", "-b ", "-f ", "-e ", "-r ", "--backlog_wait_time", "--loginuid-immutable", "--reset-lost"}
+
+func isControlLine(line string) bool {
+	for _, prefix := range controlPrefixes {
+		if line == strings.TrimSpace(prefix) || strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readRules() reads an auditctl style rule file, skipping comments, blank lines and control lines
+func readRules(r io.Reader, source string) ([]ruleLine, error) {
+	var rules []ruleLine
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		rule2add := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(rule2add, "#") || rule2add == "" {
+			continue
+		}
+		if isControlLine(rule2add) {
+			if *verbose {
+				fmt.Printf("skip> %s:%d %s\n", source, lineNum, rule2add)
+			}
+			continue
+		}
+		rules = append(rules, ruleLine{Rule: rule2add, Source: source, Line: lineNum})
+	}
+	return rules, scanner.Err()
+}
+
+// wantedRules() returns every rule bonk should load, in order: the embedded set, the *.rules files in
+// rules-dir sorted by name (like /etc/audit/rules.d), then the rules in config.json
+func wantedRules() ([]ruleLine, error) {
+	data, err := res.Open("embed/good.rules")
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	rules, err := readRules(data, "embed/good.rules")
+	if err != nil {
+		return nil, err
+	}
+
+	if cf.RulesDir != "" {
+		files, err := filepath.Glob(filepath.Join(cf.RulesDir, "*.rules"))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(cf.RulesDir); err != nil {
+			return nil, fmt.Errorf("rules-dir: %w", err)
+		}
+
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			fileRules, err := readRules(f, file)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			rules = append(rules, fileRules...)
+		}
+	}
+
+	for i, rule2add := range cf.Rules {
+		if rule2add = strings.TrimSpace(rule2add); !strings.HasPrefix(rule2add, "#") && rule2add != "" {
+			rules = append(rules, ruleLine{Rule: rule2add, Source: configFile(), Line: i + 1})
+		}
+	}
+
+	return rules, nil
+}
+
+// configFile() is the config.json in use
+func configFile() string {
+	if *configPath != "" {
+		return *configPath
+	}
+	return CONFIGPATH
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWantedRulesMergesInOrder(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "20-b.rules"), []byte("-w /etc/b -p wa -k b\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "10-a.rules"), []byte("-D\n-b 8192\n# comment\n\n-w /etc/a -p wa -k a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("-w /etc/nope -p wa -k nope\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setupReceive(t, "load", Config{RulesDir: dir, Rules: []string{"-w /etc/docker -k docker"}})
+
+	rules, err := wantedRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(rules)
+	if n < 4 {
+		t.Fatalf("got %d rules", n)
+	}
+	if rules[0].Source != "embed/good.rules" {
+		t.Errorf("first rule from %s, want embed/good.rules", rules[0].Source)
+	}
+
+	want := []ruleLine{
+		{Rule: "-w /etc/a -p wa -k a", Source: filepath.Join(dir, "10-a.rules"), Line: 5},
+		{Rule: "-w /etc/b -p wa -k b", Source: filepath.Join(dir, "20-b.rules"), Line: 1},
+		{Rule: "-w /etc/docker -k docker", Source: configFile(), Line: 1},
+	}
+	for i, w := range want {
+		if got := rules[n-len(want)+i]; got != w {
+			t.Errorf("rule %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestLoadAddsConfigRules(t *testing.T) {
+	setupReceive(t, "load", Config{Rules: []string{"-w /etc/docker -k docker"}})
+	src := newMemorySource(t)
+
+	if err := load(src); err != nil {
+		t.Fatal(err)
+	}
+
+	want := string(buildRule(t, "-w /etc/docker -k docker"))
+	for _, r := range src.rules {
+		if string(r) == want {
+			return
+		}
+	}
+	t.Error("rule from config.json was not loaded")
+}
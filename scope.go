@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// how far a kill or stop reaches
+const (
+	ScopeProcess = "process" // just the pid in the audit record, the default
+	ScopeTree    = "tree"    // the process and everything it spawned
+	ScopeGroup   = "pgroup"  // the process group (a shell pipeline or job)
+	ScopeSession = "session" // the session (everything started from that terminal or reverse shell)
+	ScopeLogin   = "login"   // every process with the same auid and ses as the audit record
+)
+
+// the auid/ses the kernel uses for "not set"
+const UNSETID = "4294967295"
+
+func validScope(scope string) bool {
+	switch scope {
+	case "", ScopeProcess, ScopeTree, ScopeGroup, ScopeSession, ScopeLogin:
+		return true
+	}
+	return false
+}
+
+// procInfo is the part of /proc/<pid> the scopes are worked out from
+type procInfo struct {
+	pid, ppid, pgrp, session int
+	auid, ses                string
+}
+
+// readProc() reads one /proc/<pid>
+func readProc(pid int) (procInfo, error) {
+	info := procInfo{pid: pid}
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return info, err
+	}
+	end := strings.LastIndexByte(string(data), ')')
+	if end == -1 {
+		return info, fmt.Errorf("bad stat for %d", pid)
+	}
+	// state ppid pgrp session
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 4 {
+		return info, fmt.Errorf("bad stat for %d", pid)
+	}
+	info.ppid, _ = strconv.Atoi(fields[1])
+	info.pgrp, _ = strconv.Atoi(fields[2])
+	info.session, _ = strconv.Atoi(fields[3])
+
+	if auid, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/loginuid", pid)); err == nil {
+		info.auid = strings.TrimSpace(string(auid))
+	}
+	if ses, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/sessionid", pid)); err == nil {
+		info.ses = strings.TrimSpace(string(ses))
+	}
+	return info, nil
+}
+
+// readProcs() reads every process in /proc. Processes that exit halfway through are skipped
+func readProcs() []procInfo {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var procs []procInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if info, err := readProc(pid); err == nil {
+			procs = append(procs, info)
+		}
+	}
+	return procs
+}
+
+// scopePids() works out which pids a scope covers, from /proc as it is right now. The pid from the audit record
+// always comes first. The scope actually used is returned too, login falls back to tree when the event has no auid/ses
+func scopePids(scope string, a AuditMessageBonk) ([]int, string) {
+	if scope == "" || scope == ScopeProcess {
+		return []int{a.Pid}, ScopeProcess
+	}
+
+	target, err := readProc(a.Pid)
+	if err != nil {
+		// it is already gone, nothing to widen from
+		return []int{a.Pid}, ScopeProcess
+	}
+
+	auid, ses := a.Auid, a.Ses
+	if scope == ScopeLogin && (auid == "" || auid == UNSETID || ses == "" || ses == UNSETID || ses == "unset") {
+		// every daemon shares the unset auid, that is not a login to kill
+		scope = ScopeTree
+	}
+
+	procs := readProcs()
+	pids := []int{a.Pid}
+	seen := map[int]bool{a.Pid: true}
+	add := func(pid int) {
+		if !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+
+	switch scope {
+	case ScopeTree:
+		children := make(map[int][]int)
+		for _, p := range procs {
+			children[p.ppid] = append(children[p.ppid], p.pid)
+		}
+		for queue := []int{a.Pid}; len(queue) > 0; queue = queue[1:] {
+			for _, child := range children[queue[0]] {
+				if !seen[child] {
+					add(child)
+					queue = append(queue, child)
+				}
+			}
+		}
+	case ScopeGroup:
+		for _, p := range procs {
+			if p.pgrp == target.pgrp {
+				add(p.pid)
+			}
+		}
+	case ScopeSession:
+		for _, p := range procs {
+			if p.session == target.session {
+				add(p.pid)
+			}
+		}
+	case ScopeLogin:
+		for _, p := range procs {
+			if p.auid == auid && p.ses == ses {
+				add(p.pid)
+			}
+		}
+	}
+
+	sort.Ints(pids[1:])
+	return pids, scope
+}
+
+// procEvent() dresses up another pid in the scope as an event so it goes through the same checks as the one reported
+func procEvent(pid int, a AuditMessageBonk) AuditMessageBonk {
+	target := AuditMessageBonk{Pid: pid, Key: a.Key, AuidHumanReadable: "unset"}
+	target.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+		target.Argv = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	}
+	if info, err := readProc(pid); err == nil {
+		if info.auid != "" && info.auid != UNSETID {
+			target.Auid = info.auid
+			if u, err := user.LookupId(info.auid); err == nil {
+				target.AuidHumanReadable = u.Username
+			}
+		}
+		target.Ancestry = ancestryOf(pid, info.ppid, target.Exe, "")
+	}
+	return target
+}
+
+// scopeTargets() is scopePids() minus the processes that are protected or allowed, with the reason each one was skipped.
+// The policy's ancestor and cmdline only decide whether the reported event is acted on, the other pids only go through the allow checks
+func scopeTargets(p Policy, a AuditMessageBonk) (targets []int, skipped []string, scope string) {
+	pids, scope := scopePids(p.Scope, a)
+	for i, pid := range pids {
+		target := a
+		if i > 0 {
+			target = procEvent(pid, a)
+			if why, allowed := scopeAllows(p, target); allowed {
+				skipped = append(skipped, fmt.Sprintf("%d %s", pid, why))
+				continue
+			}
+		}
+		if protected, why := isProtected(target); protected {
+			skipped = append(skipped, fmt.Sprintf("%d %s", pid, why))
+			continue
+		}
+		targets = append(targets, pid)
+	}
+	return targets, skipped, scope
+}
+
+// scopeAllows() puts another pid of the scope through the same allow lists bonkProc uses: allowed user/exe, trusted exes and -bonkip-a
+func scopeAllows(p Policy, target AuditMessageBonk) (string, bool) {
+	if p.allowsProcess(target) {
+		return "allowed", true
+	}
+	if trusted, _ := cf.TrustedExe(target); trusted {
+		return "trusted exe", true
+	}
+	if *BonkByIPAllow {
+		for _, ip := range lookupIPs(target.Pid) {
+			if cf.AllowedIP(ip) {
+				return "allowed IP " + ip, true
+			}
+		}
+	}
+	return "", false
+}
+
+// scopeNote() is what a log line gets when the action reached further than the one process
+func scopeNote(acted actReport) string {
+	if (acted.scope == "" || acted.scope == ScopeProcess) && len(acted.skipped) == 0 {
+		return ""
+	}
+	pids := make([]string, len(acted.done))
+	for i, pid := range acted.done {
+		pids[i] = strconv.Itoa(pid)
+	}
+	note := fmt.Sprintf(" %s: %s;", acted.scope, strings.Join(pids, ","))
+	if len(acted.skipped) > 0 {
+		note += fmt.Sprintf(" skipped: %s;", strings.Join(acted.skipped, ", "))
+	}
+	return note
+}
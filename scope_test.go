@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startShell starts a shell with two children in its own process group, and waits until /proc shows them
+func startShell(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	pid := cmd.Process.Pid
+	t.Cleanup(func() {
+		syscall.Kill(-pid, syscall.SIGKILL)
+		cmd.Wait()
+	})
+
+	for i := 0; i < 100; i++ {
+		if pids, _ := scopePids(ScopeTree, AuditMessageBonk{Pid: pid}); len(pids) == 3 {
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("children never showed up")
+	return 0
+}
+
+func TestScopePids(t *testing.T) {
+	pid := startShell(t)
+
+	for _, scope := range []string{ScopeTree, ScopeGroup} {
+		pids, used := scopePids(scope, AuditMessageBonk{Pid: pid})
+		if used != scope || len(pids) != 3 || pids[0] != pid {
+			t.Errorf("%s: got %v (%s), want the shell and both sleeps", scope, pids, used)
+		}
+	}
+
+	if pids, used := scopePids(ScopeProcess, AuditMessageBonk{Pid: pid}); used != ScopeProcess || len(pids) != 1 {
+		t.Errorf("process: got %v", pids)
+	}
+
+	// no auid to go by, so login falls back to the tree
+	if pids, used := scopePids(ScopeLogin, AuditMessageBonk{Pid: pid}); used != ScopeTree || len(pids) != 3 {
+		t.Errorf("login without auid: got %v (%s)", pids, used)
+	}
+}
+
+func TestActKillsWholeTree(t *testing.T) {
+	pid := startShell(t)
+	killed, _ := setupReceive(t, "bonk", testConfig)
+	stopped := []int{}
+	oldStop := stopPid
+	stopPid = func(pid int) error {
+		stopped = append(stopped, pid)
+		return nil
+	}
+	t.Cleanup(func() { stopPid = oldStop })
+
+	acted, err := Policy{Action: ActionKill, Users: []string{}, Scope: ScopeTree}.act(AuditMessageBonk{Pid: pid, Exe: "/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*killed) != 3 || (*killed)[0] != pid || len(acted.done) != 3 {
+		t.Errorf("killed %v, reported %v, want the shell and both sleeps", *killed, acted.done)
+	}
+	if len(stopped) != 3 {
+		t.Errorf("stopped %v first, want all three", stopped)
+	}
+	if note := scopeNote(acted); note == "" {
+		t.Error("no pids in the log line")
+	}
+}
+
+func TestLoadRejectsUnknownScope(t *testing.T) {
+	if err := loadTestConfig(t, `{"policies": {"tracing": {"scope": "everything"}}}`); err == nil {
+		t.Error("unknown scope was accepted")
+	}
+}
+
+func TestScopeIgnoresTriggersOnOtherPids(t *testing.T) {
+	pid := startShell(t)
+	killed, _ := setupReceive(t, "bonk", testConfig)
+	oldStop := stopPid
+	stopPid = func(pid int) error { return nil }
+	t.Cleanup(func() { stopPid = oldStop })
+
+	// the sleeps do not match the cmdline themselves, they go down with the shell that did
+	p := Policy{Action: ActionKill, Users: []string{}, Scope: ScopeTree, Cmdline: []string{"sleep 30 &"}}
+	a := AuditMessageBonk{Pid: pid, Exe: "/bin/sh", Argv: []string{"sh", "-c", "sleep 30 & sleep 30 & wait"}}
+	if p.Allows(a) {
+		t.Fatal("the shell matches the cmdline")
+	}
+	acted, err := p.act(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*killed) != 3 || len(acted.skipped) != 0 {
+		t.Errorf("killed %v, skipped %v, want the shell and both sleeps", *killed, acted.skipped)
+	}
+}
+
+func TestScopeSkipsTrustedExes(t *testing.T) {
+	pid := startShell(t)
+	pids, _ := scopePids(ScopeTree, AuditMessageBonk{Pid: pid})
+	sleep, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pids[1]))
+	if err != nil {
+		t.Skip(err)
+	}
+	sum, err := hashFile(sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig
+	config.TrustedExes = []TrustedExe{{Path: sleep, SHA256: sum}}
+	killed, _ := setupReceive(t, "bonk", config)
+	oldStop := stopPid
+	stopPid = func(pid int) error { return nil }
+	t.Cleanup(func() { stopPid = oldStop })
+
+	acted, err := Policy{Action: ActionKill, Users: []string{}, Scope: ScopeTree}.act(AuditMessageBonk{Pid: pid, Exe: "/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*killed) != 1 || (*killed)[0] != pid {
+		t.Errorf("killed %v, want only the shell", *killed)
+	}
+	if len(acted.skipped) != 2 || !strings.HasSuffix(acted.skipped[0], "trusted exe") {
+		t.Errorf("skipped %v, want both sleeps as trusted", acted.skipped)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/elastic/go-libaudit/v2"
+)
+
+// auditSource is the slice of the kernel audit client that bonk uses. *libaudit.AuditClient satisfies it,
+// the tests swap in an in-memory one
+type auditSource interface {
+	Receive(nonBlocking bool) (*libaudit.RawAuditMessage, error)
+	AddRule(rule []byte) error
+	GetRules() ([][]byte, error)
+	DeleteRule(rule []byte) error
+	GetStatus() (*libaudit.AuditStatus, error)
+	SetPID(wm libaudit.WaitMode) error
+	SetEnabled(enabled bool, wm libaudit.WaitMode) error
+	SetRateLimit(perSecondLimit uint32, wm libaudit.WaitMode) error
+	SetBacklogLimit(limit uint32, wm libaudit.WaitMode) error
+	WaitForPendingACKs() error
+	Close() error
+}
+
+// killPid is how bonk nukes a process. It is a variable so the tests can watch the kills instead of doing them
+var killPid = func(pid int) error {
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elastic/go-libaudit/rule"
+	"github.com/elastic/go-libaudit/rule/flags"
+	"github.com/fatih/color"
+)
+
+// syncPlan is what sync has to do to the kernel to get it to match our rules
+type syncPlan struct {
+	// rules we want but the kernel does not have (or has in the wrong place), in the order they go in
+	add []ruleLine
+	// rules the kernel has but we do not want (or has in the wrong place), kept in the kernel's own format so they can be deleted as is
+	del       []rule.WireFormat
+	delString []string
+	// rules that are already loaded in the right place
+	keep int
+	// rules that are loaded but out of order, so they are deleted and added again
+	reorder int
+}
+
+// canonicalRule() turns a rule in wire format back into auditctl syntax so two spellings of the same rule compare equal
+func canonicalRule(wf rule.WireFormat) (string, error) {
+	return rule.ToCommandLine(wf, false)
+}
+
+// ruleList() is the filter list a rule goes on ("-a never,exclude ..." is on exclude, watches are on exit).
+// The kernel checks each list on its own, first match wins, so order only matters within one list
+func ruleList(canonical string) string {
+	fields := strings.Fields(canonical)
+	if len(fields) < 2 || (fields[0] != "-a" && fields[0] != "-A") {
+		return "exit"
+	}
+	for _, part := range strings.Split(fields[1], ",") {
+		switch part {
+		case "always", "never":
+		default:
+			return part
+		}
+	}
+	return "exit"
+}
+
+// planSync() diffs the kernel's rules against the wanted ones. Audit is first match wins, so a rule that is
+// missing in the middle of a list can not just be added at the end: from the first place the kernel's order
+// differs from ours everything on that list is deleted and added again in order
+func planSync(r auditSource, wanted []ruleLine) (syncPlan, error) {
+	var plan syncPlan
+
+	loaded, err := r.GetRules()
+	if err != nil {
+		return plan, fmt.Errorf("failed to get rules from kernel: %w", err)
+	}
+
+	// what is in the kernel, by canonical form and in the kernel's order
+	type kernelRule struct {
+		wf        rule.WireFormat
+		canonical string
+	}
+	var current []kernelRule
+	for _, raw := range loaded {
+		wf := rule.WireFormat(raw)
+		canonical, err := canonicalRule(wf)
+		if err != nil {
+			return plan, fmt.Errorf("failed to read kernel rule: %w", err)
+		}
+		current = append(current, kernelRule{wf, canonical})
+	}
+
+	type wantedRule struct {
+		line      ruleLine
+		canonical string
+	}
+	var wants []wantedRule
+	wantedCanonical := make(map[string]bool)
+	for _, want := range wanted {
+		rule2add := want.Rule
+
+		// a broken rule should not hold the rest back
+		ru, err := flags.Parse(rule2add)
+		if err != nil {
+			fmt.Printf("error> %s failed to parse rule %q: %s\n", want, rule2add, err)
+			continue
+		}
+		wf, err := rule.Build(ru)
+		if err != nil {
+			fmt.Printf("error> %s failed to build rule %q: %s\n", want, rule2add, err)
+			continue
+		}
+		canonical, err := canonicalRule(wf)
+		if err != nil {
+			fmt.Printf("error> %s failed to read rule %q: %s\n", want, rule2add, err)
+			continue
+		}
+
+		// the same rule written twice only goes in once
+		if wantedCanonical[canonical] {
+			continue
+		}
+		wantedCanonical[canonical] = true
+		wants = append(wants, wantedRule{want, canonical})
+	}
+
+	// per list, how far the kernel's rules (minus the stale ones) line up with ours
+	kept := make(map[string][]string)
+	for _, k := range current {
+		if wantedCanonical[k.canonical] {
+			list := ruleList(k.canonical)
+			kept[list] = append(kept[list], k.canonical)
+		}
+	}
+	inOrder := make(map[string]int)
+	position := make(map[string]int)
+	for _, want := range wants {
+		list := ruleList(want.canonical)
+		i := position[list]
+		position[list]++
+		if i == inOrder[list] && i < len(kept[list]) && kept[list][i] == want.canonical {
+			inOrder[list]++
+		}
+	}
+
+	// everything past the first difference comes out, in the kernel's order
+	keptIndex := make(map[string]int)
+	for _, k := range current {
+		if !wantedCanonical[k.canonical] {
+			plan.del = append(plan.del, k.wf)
+			plan.delString = append(plan.delString, k.canonical)
+			continue
+		}
+		list := ruleList(k.canonical)
+		i := keptIndex[list]
+		keptIndex[list]++
+		if i < inOrder[list] {
+			plan.keep++
+			continue
+		}
+		plan.del = append(plan.del, k.wf)
+		plan.delString = append(plan.delString, k.canonical)
+		plan.reorder++
+	}
+
+	// and goes back in (with whatever was missing) in our order
+	position = make(map[string]int)
+	for _, want := range wants {
+		list := ruleList(want.canonical)
+		i := position[list]
+		position[list]++
+		if i >= inOrder[list] {
+			plan.add = append(plan.add, want.line)
+		}
+	}
+
+	return plan, nil
+}
+
+// mode=sync : makes the kernel's rules match embed/good.rules + rules-dir + config.json, only touching what changed
+func syncRules(r auditSource, dryRun bool) error {
+	wanted, err := wantedRules()
+	if err != nil {
+		return err
+	}
+
+	plan, err := planSync(r, wanted)
+	if err != nil {
+		return err
+	}
+
+	for _, rule2add := range plan.add {
+		fmt.Printf("[%s] %s\t(%s)\n", color.GreenString("+"), rule2add.Rule, rule2add)
+	}
+	for _, rule2del := range plan.delString {
+		fmt.Printf("[%s] %s\n", color.RedString("-"), rule2del)
+	}
+	fmt.Printf("[!] %d to add, %d to delete, %d unchanged\n", len(plan.add), len(plan.del), plan.keep)
+	if plan.reorder > 0 {
+		fmt.Printf("[!] %d of those are loaded out of order and get deleted and added again\n", plan.reorder)
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	return applySync(r, plan)
+}
+
+// applySync() does the plan: deletes first so a watch that moved does not trip over its old self, and so the adds land in order at the end of their list
+func applySync(r auditSource, plan syncPlan) error {
+	for i, wf := range plan.del {
+		r.WaitForPendingACKs()
+		if err := r.DeleteRule(wf); err != nil {
+			fmt.Printf("error> failed to delete rule %s: %s\n", plan.delString[i], err)
+		}
+	}
+
+	for _, rule2add := range plan.add {
+		if err := ruleAddWrapper(rule2add.Rule, r); err != nil {
+			fmt.Printf("error> %s %s\n", rule2add, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/elastic/go-libaudit/rule"
+	"github.com/elastic/go-libaudit/rule/flags"
+)
+
+func buildRule(t *testing.T, line string) []byte {
+	t.Helper()
+	ru, err := flags.Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf, err := rule.Build(ru)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wf
+}
+
+func TestSyncRules(t *testing.T) {
+	setupReceive(t, "sync", Config{Rules: []string{"-w /var/www/html -p wa -k apache"}})
+	src := newMemorySource(t)
+	src.rules = [][]byte{
+		buildRule(t, "-w /var/www/html -p wa -k apache"),
+		buildRule(t, "-w /tmp/stale -p wa -k stale"),
+	}
+
+	wanted, err := wantedRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncRules(src, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.rules) != 2 {
+		t.Fatalf("dry run changed the kernel rules, got %d", len(src.rules))
+	}
+
+	if err := syncRules(src, false); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := planSync(src, wanted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.add) != 0 || len(plan.del) != 0 {
+		t.Errorf("second sync still has work: add=%v del=%v", plan.add, plan.delString)
+	}
+	for _, raw := range src.rules {
+		if line, _ := canonicalRule(raw); line == "-w /tmp/stale -p wa -k stale" {
+			t.Error("stale rule was not deleted")
+		}
+	}
+}
+
+func ruleLines(rules ...string) []ruleLine {
+	lines := make([]ruleLine, len(rules))
+	for i, r := range rules {
+		lines[i] = ruleLine{Rule: r, Source: "test", Line: i + 1}
+	}
+	return lines
+}
+
+func TestSyncKeepsRuleOrder(t *testing.T) {
+	setupReceive(t, "sync", testConfig)
+	exclude := "-a never,exit -F dir=/dev/shm -k sharedmemaccess"
+	watch := "-w /dev/shm -p wa -k shm"
+	other := "-w /etc/passwd -p wa -k passwd_modification"
+	filter := "-a always,exclude -F msgtype=CWD"
+
+	tests := []struct {
+		name    string
+		kernel  []string
+		wanted  []string
+		add     int
+		del     int
+		reorder int
+	}{
+		// the never rule went missing, added at the end it would come after the watch it has to shadow
+		{"missing exclusion", []string{watch, other}, []string{exclude, watch, other}, 3, 2, 2},
+		// missing at the end is just an add
+		{"missing last", []string{exclude, watch}, []string{exclude, watch, other}, 1, 0, 0},
+		{"swapped", []string{watch, exclude, other}, []string{exclude, watch, other}, 3, 3, 3},
+		// the exclude list is checked on its own, where it sits between exit rules does not matter
+		{"other list", []string{exclude, watch, filter}, []string{filter, exclude, watch}, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := newMemorySource(t)
+			for _, r := range test.kernel {
+				src.rules = append(src.rules, buildRule(t, r))
+			}
+
+			plan, err := planSync(src, ruleLines(test.wanted...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.add) != test.add || len(plan.del) != test.del || plan.reorder != test.reorder {
+				t.Fatalf("add=%d del=%d reorder=%d, want %d %d %d", len(plan.add), len(plan.del), plan.reorder, test.add, test.del, test.reorder)
+			}
+
+			if err := applySync(src, plan); err != nil {
+				t.Fatal(err)
+			}
+			byList := make(map[string][]string)
+			for _, raw := range src.rules {
+				line, _ := canonicalRule(raw)
+				byList[ruleList(line)] = append(byList[ruleList(line)], line)
+			}
+			for _, r := range test.wanted {
+				want, _ := canonicalRule(buildRule(t, r))
+				list := ruleList(want)
+				if len(byList[list]) == 0 || byList[list][0] != want {
+					t.Fatalf("kernel has %v, want %v", byList, test.wanted)
+				}
+				byList[list] = byList[list][1:]
+			}
+		})
+	}
+}
+
+func TestSyncDryRunLeavesKernelAlone(t *testing.T) {
+	setupReceive(t, "sync", Config{Rules: []string{"-w /var/www/html -p wa -k apache"}})
+	*dryRun = true
+	t.Cleanup(func() { *dryRun = false })
+	src := newMemorySource(t)
+	src.rules = [][]byte{buildRule(t, "-w /tmp/stale -p wa -k stale")}
+
+	if err := runMode(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if src.enabled || src.pidSet {
+		t.Errorf("enabled=%v pidSet=%v, want the kernel left alone", src.enabled, src.pidSet)
+	}
+	if len(src.rules) != 1 {
+		t.Errorf("dry run changed the kernel rules, got %d", len(src.rules))
+	}
+}
@@ -5,11 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"syscall"
+	"time"
 
 	"github.com/elastic/go-libaudit/rule"
 	"github.com/elastic/go-libaudit/rule/flags"
-	"github.com/elastic/go-libaudit/v2"
 	"github.com/fatih/color"
 )
 
@@ -43,48 +42,41 @@ func dumpConfig() error {
 
 }
 
-// handleIP() takes a pid and the event string to log which IP's are naughty
-func handleIP(pid int, event string) {
-	// wacky code which reads /proc/*PID*/net/tcp for established ip addresses
-	establishedIPAdresses, err := getIPfromPID(pid)
-	if err == nil {
-		for key := range establishedIPAdresses {
-
-			if _, exists := IPAddresses[key]; !exists {
-				IPAddresses[key] = 0
-			} else {
-				IPAddresses[key] += 1
-				if IPAddresses[key] > *BonksBeforeWarn {
-					OutPutMessage := fmt.Sprintf("[WARN] THE IP ADDRESS %s IS BEING SUSPICIOUS", color.HiYellowString(key))
-					fmt.Println(OutPutMessage)
-					IPAddresses[key] = 0 // reset the warns back to 0
-				}
+// handleIP() counts an offense against every IP the process is talking to and warns (and blocks) the ones that keep coming back.
+// Only for verdicts that denied something (BONK, STOP, FREEZE, DENY-IP): an allowed admin's own SSH connection must never add up to a block
+func handleIP(a AuditMessageBonk, ips []string) {
+	if len(ips) == 0 {
+		return
+	}
 
-			}
-			saveIP(key, event)
+	now := time.Now()
+	for _, key := range ips {
+		record, exists := IPAddresses[key]
+		if !exists {
+			record = &ipRecord{}
+			IPAddresses[key] = record
 		}
-	}
-}
 
-// saveIP is POC code to show saving IP address
-func saveIP(ip string, event string) error {
-	output, err := os.OpenFile(IPADDRESSES, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
-	if err != nil {
-		return err
+		if record.offend(a.Key, now, *decay) > *BonksBeforeWarn {
+			OutPutMessage := fmt.Sprintf("[WARN] THE IP ADDRESS %s IS BEING SUSPICIOUS", color.HiYellowString(key))
+			// the connection was read from the container's network namespace, not the host's
+			if a.InContainer() {
+				OutPutMessage += fmt.Sprintf(" (seen from container %s/%s, netns %s)", a.ContainerRuntime, shortID(a.ContainerID), a.Namespaces["net"])
+			}
+			fmt.Println(OutPutMessage)
+			record.Count = 0 // reset the warns back to 0
+			// suspicious for long enough, shut the door
+			blockIP(key, fmt.Sprintf("more than %d bonkable events", *BonksBeforeWarn))
+		}
 	}
-	defer output.Close()
 
-	output.WriteString(event + "IP=" + ip + "\n---\n")
-	if err != nil {
-		return err
+	if err := saveIPState(ipStatePath, IPAddresses); err != nil && *verbose {
+		fmt.Printf("error> %s\n", err)
 	}
-
-	return nil
-
 }
 
 // ruleAddWrapper() takes the string to add plus the client and handles the weird translation process to get the kernel to like it
-func ruleAddWrapper(rule2add string, r *libaudit.AuditClient) error {
+func ruleAddWrapper(rule2add string, r auditSource) error {
 	/*
 		Could in theory make this faster by using goroutines but I do not want to find a race condition in the kernel
 	*/
@@ -123,84 +115,117 @@ func bonkProc(a AuditMessageBonk, prev string) (string, error) {
 
 	var outMessage string
 
+	// the connections have to be read before anything is done to the process, a dead one has none left
+	var ips []string
+	if _, bonkable := cf.PolicyFor(a.Key); bonkable || *BonkByIPDeny || *format == "json" {
+		ips = lookupIPs(a.Pid)
+	}
+
 	// try to bonk the process by IP
 	if (*mode == "bonk" || *mode == "honk") && *BonkByIPDeny {
 		// check to see if the process has been bonked
-		if status := bonkIP(a); status {
+		if status, err := bonkIP(a, ips); status {
+			var protected protectedError
+			if errors.As(err, &protected) {
+				outMessage = protectedEvent(a, ActionKill, protected.why)
+				report(newDecision("PROTECTED", a, ips, ActionKill, err.Error()), outMessage, prev, true)
+				return outMessage, nil
+			}
 			outMessage = fmt.Sprintf("[%s] USER:%s\t;KEY %s\t; CMD: %s;\tCMD_F: %s;\t", color.RedString("DENY-IP"),
 				color.RedString(a.AuidHumanReadable), color.RedString(a.Key),
-				color.RedString(a.Exe), color.RedString(a.Proctile),
+				color.RedString(a.Exe), color.RedString(a.CommandLine()),
 			)
-			if prev != outMessage {
-				CoolLogger.Println(outMessage)
-				if *verbose {
-					fmt.Println(outMessage)
-				}
-			}
-			handleIP(a.Pid, outMessage)
+			report(newDecision("DENY-IP", a, ips, ActionKill, actionResult(err)), outMessage, prev, false)
+			handleIP(a, ips)
 			return outMessage, nil
 		}
 	}
 
 	// if the offense is bonkable
-	if cf.IsBonkable(a.Key) {
+	if policy, bonkable := cf.PolicyFor(a.Key); bonkable {
+		policy = policy.forEvent(a)
 
-		// and the user is *not* allowed
-		if !cf.AllowedUser(a.AuidHumanReadable) {
+		// and the user (and exe) is *not* allowed
+		if !policy.Allows(a) {
+
+			// pinned binaries get a pass, as long as they still hash to what was pinned
+			trusted, err := cf.TrustedExe(a)
+			if err != nil {
+				CoolLogger.Printf("[%s] %s\n", color.HiYellowString("WARN"), err)
+				if *verbose {
+					fmt.Printf("[%s] %s\n", color.HiYellowString("WARN"), err)
+				}
+			}
+			if trusted {
+				outMessage = formatEvent("ALLOW-EXE", color.GreenString, a)
+				report(newDecision("ALLOW-EXE", a, ips, "", ""), outMessage, prev, false)
+				return outMessage, nil
+			}
 
 			// do not bonk some IP addresses if it is in the approvad IP address list
 			if *BonkByIPAllow {
-				IPs, _ := getIPfromPID(a.Pid)
-				for ip := range IPs {
+				for _, ip := range ips {
 					if cf.AllowedIP(ip) {
 						// output message
 						outMessage = fmt.Sprintf("[%s:%s] USER:%s\t;KEY %s\t; CMD: %s;\tCMD_F: %s;\t", color.GreenString("ALLOW-IP"), color.GreenString(ip),
 							color.GreenString(a.AuidHumanReadable), color.GreenString(a.Key),
-							color.GreenString(a.Exe), color.GreenString(a.Proctile),
+							color.GreenString(a.Exe), color.GreenString(a.CommandLine()),
 						)
-
-						if prev != outMessage {
-							CoolLogger.Print(outMessage)
-							if *verbose {
-								fmt.Println(outMessage)
-							}
-						}
+						report(newDecision("ALLOW-IP", a, ips, "", ""), outMessage, prev, false)
 						return outMessage, nil
 					}
 				}
 			}
 
-			// otherwise, nuke the process
-			if *mode == "bonk" { // bonk the process!
+			// not enough strikes yet, just count it
+			if hits, reached := policy.hit(a.Key, a.AuidHumanReadable); !reached {
+				outMessage = formatEvent(fmt.Sprintf("STRIKE %d/%d", hits, policy.Threshold), color.YellowString, a)
+				report(newDecision("STRIKE", a, ips, policy.Action, "waiting for threshold"), outMessage, prev, false)
+				return outMessage, nil
+			}
 
-				syscall.Kill(a.Pid, syscall.SIGKILL)
+			// never take down init, sshd or bonk itself, however wrong allowed-user is
+			if policy.touchesProcess() {
+				if protected, why := isProtected(a); protected {
+					outMessage = protectedEvent(a, policy.Action, why)
+					report(newDecision("PROTECTED", a, ips, policy.Action, protectedError{why}.Error()), outMessage, prev, true)
+					return outMessage, nil
+				}
 			}
 
-			outMessage = fmt.Sprintf("[%s] USER:%s\t;KEY %s\t; CMD: %s;\tCMD_F: %s;\t", color.RedString("BONK"),
-				color.RedString(a.AuidHumanReadable), color.RedString(a.Key),
-				color.RedString(a.Exe), color.RedString(a.Proctile),
-			)
-			if prev != outMessage {
-				CoolLogger.Println(outMessage)
-				if *verbose {
-					fmt.Println(outMessage)
+			// otherwise, do what the policy says (nuke the process by default)
+			result := ""
+			var acted actReport
+			bundle := ""
+			if policy.touchesProcess() {
+				result = "honk"
+				if *mode == "bonk" { // bonk the process!
+					// once it is dead all that is left is the log line
+					if policy.Action == ActionKill {
+						bundle = gatherEvidence(a)
+					}
+					var err error
+					acted, err = policy.act(a)
+					result = actionResult(err)
 				}
 			}
-			handleIP(a.Pid, outMessage)
+
+			label, paint := policy.label()
+			outMessage = formatEvent(label, paint, a) + scopeNote(acted)
+			d := newDecision(label, a, ips, policy.Action, result)
+			d.Scope, d.PIDs, d.Skipped, d.Evidence = acted.scope, acted.done, acted.skipped, bundle
+			report(d, outMessage, prev, policy.Action == ActionAlert)
+			// only what was actually denied counts against the IP, log and alert do not
+			if policy.touchesProcess() {
+				handleIP(a, ips)
+			}
 			return outMessage, nil
 		} else { // otherwise the user is allowed
 			outMessage = fmt.Sprintf("[%s] USER:%s\t;KEY %s\t; CMD: %s;\tCMD_F: %s;\t", color.HiMagentaString("COOL"),
 				color.HiMagentaString(a.AuidHumanReadable), color.HiMagentaString(a.Key),
-				color.HiMagentaString(a.Exe), color.HiMagentaString(a.Proctile),
+				color.HiMagentaString(a.Exe), color.HiMagentaString(a.CommandLine()),
 			)
-
-			if prev != outMessage {
-				CoolLogger.Print(outMessage)
-				if *verbose {
-					fmt.Println(outMessage)
-				}
-			}
-			handleIP(a.Pid, outMessage)
+			report(newDecision("COOL", a, ips, "", ""), outMessage, prev, false)
 			return outMessage, nil
 		}
 
@@ -211,15 +236,9 @@ func bonkProc(a AuditMessageBonk, prev string) (string, error) {
 			if *showInfo {
 				outMessage = fmt.Sprintf("[%s] USER:%s\t;KEY %s\t; CMD: %s;\tCMD_F: %s;\t", color.BlueString("INFO"),
 					color.BlueString(a.AuidHumanReadable), color.BlueString(a.Key),
-					color.BlueString(a.Exe), color.BlueString(a.Proctile),
+					color.BlueString(a.Exe), color.BlueString(a.CommandLine()),
 				)
-				if outMessage != prev {
-					CoolLogger.Print(outMessage)
-					if *verbose {
-						fmt.Println(outMessage)
-					}
-
-				}
+				report(newDecision("INFO", a, ips, "", ""), outMessage, prev, false)
 				return outMessage, nil
 
 			}
@@ -230,20 +249,19 @@ func bonkProc(a AuditMessageBonk, prev string) (string, error) {
 }
 
 // logic to kill processes from unknown sources :) (bonkip-d)
-func bonkIP(a AuditMessageBonk) bool {
+func bonkIP(a AuditMessageBonk, processIPs []string) (bool, error) {
 	// If IP Deny
 	if (*BonkByIPDeny) && (*mode == "bonk" || *mode == "honk") {
-		processIPs, err := getIPfromPID(a.Pid)
-		if err != nil && *verbose {
-			fmt.Printf("error> %v\n", err)
-			return false
-		}
-		for IP := range processIPs {
+		for _, IP := range processIPs {
 
 			if cf.BannedIP(IP) && *BonkByIPDeny {
+				blockIP(IP, "in the deny list")
 				if *mode == "bonk" {
-					syscall.Kill(a.Pid, syscall.SIGKILL)
-					return true
+					if protected, why := isProtected(a); protected {
+						return true, protectedError{why}
+					}
+					gatherEvidence(a)
+					return true, killPid(a.Pid)
 
 				} else {
 					fmt.Printf("[Warn] Bonk -deny- would have nuked this process %v\n", IP)
@@ -253,5 +271,5 @@ func bonkIP(a AuditMessageBonk) bool {
 		}
 
 	}
-	return false
+	return false, nil
 }